@@ -0,0 +1,173 @@
+// Copyright (c) 2014 TOKUNAGA Hiroyuki
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Averaged version of the margin perceptron. Averaged weights are
+// computed lazily: when an update delta is made at time c, it is added to
+// w and c*delta is added to u. Then the average of w over all time steps
+// is w - u/c, so each update costs O(features).
+// See Hal Daume III, "A Course in Machine Learning", Chapter 4.
+
+package rakai
+
+import (
+	"io"
+)
+
+type AveragedPerceptron struct {
+	Labels   *WordManager
+	Features *WordManager
+	w        [][]float64
+	u        [][]float64 // sum of c * delta
+	schedule LearningRateSchedule
+	t        int64
+	bias_id  int64 // -1 if bias is disabled
+}
+
+func NewAveragedPerceptron(eta float64) *AveragedPerceptron {
+	var p AveragedPerceptron
+
+	p.Labels = NewWordManager()
+	p.Features = NewWordManager()
+	p.w = make([][]float64, 0)
+	p.u = make([][]float64, 0)
+	p.schedule = NewInverseScaling(eta, 0.1)
+	p.t = 0
+	p.bias_id = -1
+	return &p
+}
+
+// SetSchedule replaces the learning rate schedule, which is
+// InverseScaling by default. Call it before training.
+func (p *AveragedPerceptron) SetSchedule(s LearningRateSchedule) {
+	p.schedule = s
+}
+
+func (p *AveragedPerceptron) SetBias(enable bool) {
+	p.bias_id = new_bias_id(p.Features, enable)
+}
+
+func (p *AveragedPerceptron) words() (*WordManager, *WordManager) {
+	return p.Labels, p.Features
+}
+
+// averaged returns the averaged weight of label_id and feature_id.
+func (p *AveragedPerceptron) averaged(label_id int, feature_id int64) float64 {
+	c := float64(p.t + 1)
+	return p.w[label_id][feature_id] - p.u[label_id][feature_id]/c
+}
+
+// PredictID predicts with the averaged weights.
+func (p *AveragedPerceptron) PredictID(fv []FV) (int, float64, int, float64) {
+	return best_two(len(p.w), func(i int) float64 {
+		score := 0.0
+		for _, x := range fv {
+			if int(x.K) < len(p.w[i]) {
+				score += p.averaged(i, x.K) * x.V
+			}
+		}
+		return score
+	})
+}
+
+func (p *AveragedPerceptron) Predict(fvs []FVS) Prediction {
+	fv := append_bias(fvs2fv(p.Features, fvs, false), p.bias_id)
+	id, score, second_id, margin := p.PredictID(fv)
+	return make_prediction(p.Labels, id, score, second_id, margin)
+}
+
+func (p *AveragedPerceptron) Train(label string, fvs []FVS) {
+	true_id := p.Labels.get_word(label, true)
+	fv := append_bias(fvs2fv(p.Features, fvs, true), p.bias_id)
+
+	// training uses the current weights, not the averaged ones
+	predicted_id, _, second_id, margin := best_two(len(p.w), func(i int) float64 {
+		return product(p.w[i], fv)
+	})
+
+	if predicted_id != int(true_id) {
+		p.update_from_id(true_id, fv, 1.0)
+		p.update_from_id(int64(predicted_id), fv, -1.0)
+	} else if margin < 1.0 {
+		p.update_from_id(true_id, fv, 1.0)
+		p.update_from_id(int64(second_id), fv, -1.0)
+	}
+	p.t++
+}
+
+func (p *AveragedPerceptron) update_from_id(label_id int64, fv []FV, coeff float64) {
+	for len(p.w) < int(label_id)+1 {
+		p.w = append(p.w, make([]float64, 0))
+		p.u = append(p.u, make([]float64, 0))
+	}
+
+	c := float64(p.t + 1)
+	for i := 0; i < len(fv); i++ {
+		k := fv[i].K
+		p.w[label_id] = ensure_w(p.w[label_id], k)
+		p.u[label_id] = ensure_w(p.u[label_id], k)
+
+		delta := p.schedule.Step(label_id, k, fv[i].V*coeff, p.t)
+		p.w[label_id][k] += delta
+		p.u[label_id][k] += c * delta
+	}
+}
+
+// Freeze returns a Predictor with a copy of the averaged weights.
+func (p *AveragedPerceptron) Freeze() *Predictor {
+	w := make([][]float64, len(p.w))
+	for label_id, values := range p.w {
+		w[label_id] = make([]float64, len(values))
+		for feature_id, _ := range values {
+			w[label_id][feature_id] = p.averaged(label_id, int64(feature_id))
+		}
+	}
+	return new_predictor(p.Labels.clone(), p.Features.clone(), w)
+}
+
+// Save writes the averaged weights.
+func (p *AveragedPerceptron) Save(w io.Writer) error {
+	return save_weights(w, p.Labels, p.Features, p.Freeze().w)
+}
+
+// averaged_perceptron_state is the training state of AveragedPerceptron
+// in a checkpoint. U is needed to continue averaging.
+type averaged_perceptron_state struct {
+	Labels   *WordManager
+	Features *WordManager
+	W        [][]float64
+	U        [][]float64
+	Schedule LearningRateSchedule
+	T        int64
+	BiasID   int64
+}
+
+func (p *AveragedPerceptron) GobEncode() ([]byte, error) {
+	return gob_encode(averaged_perceptron_state{p.Labels, p.Features, p.w, p.u, p.schedule, p.t, p.bias_id})
+}
+
+func (p *AveragedPerceptron) GobDecode(data []byte) error {
+	var s averaged_perceptron_state
+	if err := gob_decode(data, &s); err != nil {
+		return err
+	}
+	p.Labels, p.Features, p.w, p.u = s.Labels, s.Features, s.W, s.U
+	p.schedule, p.t, p.bias_id = s.Schedule, s.T, s.BiasID
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2014 TOKUNAGA Hiroyuki
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package rakai
+
+import (
+	"io"
+	"sync"
+)
+
+// number of lines per worker read at once by the parallel readers
+const chunk_size = 1024
+
+type example struct {
+	line  int
+	text  string
+	label string
+	fvs   []FVS
+	pred  Prediction
+	err   *ParseError
+}
+
+// parallel_for calls f(0) ... f(n-1) with workers goroutines, and
+// returns after all calls are finished.
+func parallel_for(n int, workers int, f func(i int)) {
+	if workers <= 1 || n <= 1 {
+		for i := 0; i < n; i++ {
+			f(i)
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	size := (n + workers - 1) / workers
+	for begin := 0; begin < n; begin += size {
+		end := begin + size
+		if end > n {
+			end = n
+		}
+		wg.Add(1)
+		go func(begin, end int) {
+			defer wg.Done()
+			for i := begin; i < end; i++ {
+				f(i)
+			}
+		}(begin, end)
+	}
+	wg.Wait()
+}
+
+// PredictBatch predicts every element of batch with workers goroutines.
+// The i-th result is the prediction of batch[i].
+func (p *Predictor) PredictBatch(batch [][]FVS, workers int) []Prediction {
+	ret := make([]Prediction, len(batch))
+	parallel_for(len(batch), workers, func(i int) {
+		ret[i] = p.Predict(batch[i])
+	})
+	return ret
+}
+
+// read_chunk reads at most n lines from er. It stops early if no more
+// input is buffered, so that a slow stream does not delay the output.
+func read_chunk(er *ExampleReader, n int) ([]example, error) {
+	chunk := make([]example, 0, n)
+	for len(chunk) < n {
+		if len(chunk) > 0 && er.buffered() == 0 {
+			break
+		}
+		text, line, err := er.next_line()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		chunk = append(chunk, example{line: line, text: text})
+	}
+	return chunk, nil
+}
+
+// predict_reader parses and predicts examples of er with workers
+// goroutines, and calls emit for each example in input order. Broken
+// lines are handled in the same way as ExampleReader.Next, and if skip
+// is not nil, it is called in place of emit for each skipped line. If
+// flush is not nil, it is called after each chunk when no more input is
+// buffered.
+func predict_reader(p *Predictor, er *ExampleReader, workers int, emit func(label string, pr Prediction) error, skip func() error, flush func() error) error {
+	if workers < 1 {
+		workers = 1
+	}
+	for {
+		chunk, err := read_chunk(er, chunk_size*workers)
+		if err != nil {
+			return err
+		}
+		if len(chunk) == 0 {
+			return nil
+		}
+
+		parallel_for(len(chunk), workers, func(i int) {
+			e := &chunk[i]
+			e.label, e.fvs, e.err = er.parse(e.text)
+			if e.err == nil {
+				e.pred = p.Predict(e.fvs)
+			}
+		})
+
+		for _, e := range chunk {
+			if e.err != nil {
+				if err := er.fail(e.err, e.line); err != nil {
+					return err
+				}
+				if skip != nil {
+					if err := skip(); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if err := emit(e.label, e.pred); err != nil {
+				return err
+			}
+		}
+
+		if flush != nil && er.buffered() == 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
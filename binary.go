@@ -0,0 +1,311 @@
+// Copyright (c) 2014 TOKUNAGA Hiroyuki
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Binary model format. All integers are little endian.
+//
+//   magic     "RAKAIBIN"
+//   version   uint32
+//   precision uint32, 4 (float32) or 8 (float64)
+//   header    uint32 count, then key and value of each entry, which are
+//             uvarint length and bytes
+//   labels    uint32 count, then uvarint length and bytes of each label
+//   features  uint32 count, then uvarint length and bytes of each
+//             feature, or 0 if features are hashed
+//   weights   CSR matrix of labels x features:
+//             uint64 row offsets (labels + 1), uint32 feature ids and
+//             float32 or float64 values (nonzero weights)
+//
+// Labels and features are stored in the order of their ids, so the
+// feature ids need no lookup on loading. With float64, a model is
+// restored exactly.
+
+package rakai
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+const (
+	binary_magic   = "RAKAIBIN"
+	binary_version = 1
+)
+
+// Precision is the type of weights in the binary model format.
+type Precision uint32
+
+const (
+	Float32 Precision = 4
+	Float64 Precision = 8
+)
+
+// SaveBinary writes the model in the binary format with weights of
+// precision.
+func (p *Predictor) SaveBinary(w io.Writer, precision Precision) error {
+	if precision != Float32 && precision != Float64 {
+		return fmt.Errorf("unsupported precision: %d", precision)
+	}
+	writer := bufio.NewWriterSize(w, 4096*32)
+
+	writer.WriteString(binary_magic)
+	binary.Write(writer, binary.LittleEndian, uint32(binary_version))
+	binary.Write(writer, binary.LittleEndian, uint32(precision))
+	write_header(writer, p.Features.header())
+	write_words(writer, p.Labels)
+	write_words(writer, p.Features)
+
+	offsets := make([]uint64, p.Labels.Size()+1)
+	ids := make([]uint32, 0)
+	values := make([]float64, 0)
+	p.each_weight(func(label_id int, feature_id int64, v float64) {
+		offsets[label_id+1]++
+		ids = append(ids, uint32(feature_id))
+		values = append(values, v)
+	})
+	for i := 1; i < len(offsets); i++ {
+		offsets[i] += offsets[i-1]
+	}
+	binary.Write(writer, binary.LittleEndian, offsets)
+	binary.Write(writer, binary.LittleEndian, ids)
+	if precision == Float32 {
+		values32 := make([]float32, len(values))
+		for i, v := range values {
+			values32[i] = float32(v)
+		}
+		binary.Write(writer, binary.LittleEndian, values32)
+	} else {
+		binary.Write(writer, binary.LittleEndian, values)
+	}
+	return writer.Flush()
+}
+
+func write_words(writer *bufio.Writer, wm *WordManager) {
+	if wm.hashed() {
+		// restored from the header
+		binary.Write(writer, binary.LittleEndian, uint32(0))
+		return
+	}
+	binary.Write(writer, binary.LittleEndian, uint32(wm.Size()))
+	for id := 0; id < wm.Size(); id++ {
+		write_string(writer, wm.Word(int64(id)))
+	}
+}
+
+func write_string(writer *bufio.Writer, s string) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, uint64(len(s)))
+	writer.Write(buf[:n])
+	writer.WriteString(s)
+}
+
+func write_header(writer *bufio.Writer, header map[string]string) {
+	binary.Write(writer, binary.LittleEndian, uint32(len(header)))
+	for _, key := range header_keys(header) {
+		write_string(writer, key)
+		write_string(writer, header[key])
+	}
+}
+
+// SaveBinaryFile saves p into filename in the binary format.
+func SaveBinaryFile(p *Predictor, filename string, precision Precision) error {
+	fi, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	if err := p.SaveBinary(fi, precision); err != nil {
+		fi.Close()
+		return err
+	}
+	return fi.Close()
+}
+
+// is_binary reports whether the model read by reader is in the binary
+// format, without consuming it.
+func is_binary(reader *bufio.Reader) bool {
+	magic, err := reader.Peek(len(binary_magic))
+	return err == nil && string(magic) == binary_magic
+}
+
+var errBinaryFormat = errors.New("binary model format error: unexpected end of data")
+
+// binary_decoder reads values from data. After the first error, all
+// reads return zero values, and err has the error.
+type binary_decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *binary_decoder) next(n int) []byte {
+	if d.err != nil || n < 0 || len(d.data) < n {
+		d.err = errBinaryFormat
+		return nil
+	}
+	ret := d.data[:n]
+	d.data = d.data[n:]
+	return ret
+}
+
+func (d *binary_decoder) uint32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *binary_decoder) uint64() uint64 {
+	if b := d.next(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+// string reads a uvarint length and bytes.
+func (d *binary_decoder) string() string {
+	size, k := binary.Uvarint(d.data)
+	if k <= 0 || size > uint64(len(d.data)-k) {
+		d.err = errBinaryFormat
+		return ""
+	}
+	d.data = d.data[k:]
+	return string(d.next(int(size)))
+}
+
+func (d *binary_decoder) header() map[string]string {
+	header := make(map[string]string)
+	n := d.uint32()
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		key := d.string()
+		header[key] = d.string()
+	}
+	return header
+}
+
+// words reads a word table. Words are sliced from one string, which is
+// converted from the table at once.
+func (d *binary_decoder) words() *WordManager {
+	n := d.uint32()
+	if d.err != nil || uint64(n) > uint64(len(d.data)) {
+		d.err = errBinaryFormat
+		return nil
+	}
+
+	// find the end of the table first
+	end := 0
+	for i := uint32(0); i < n; i++ {
+		size, k := binary.Uvarint(d.data[end:])
+		if k <= 0 || size > uint64(len(d.data)-end-k) {
+			d.err = errBinaryFormat
+			return nil
+		}
+		end += k + int(size)
+	}
+	raw := d.next(end)
+	table := string(raw)
+
+	wm := NewWordManager()
+	wm.word2id = make(map[string]int64, n)
+	wm.id2word = make([]string, 0, n)
+	for pos := 0; pos < len(table); {
+		size, k := binary.Uvarint(raw[pos:])
+		pos += k
+		wm.add_word(table[pos : pos+int(size)])
+		pos += int(size)
+	}
+	return wm
+}
+
+// load_binary reads a model in the binary format.
+func load_binary(reader io.Reader) (*Predictor, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	d := &binary_decoder{data: data}
+
+	d.next(len(binary_magic))
+	version := d.uint32()
+	if d.err == nil && version != binary_version {
+		return nil, fmt.Errorf("unsupported binary model version %d", version)
+	}
+	precision := Precision(d.uint32())
+	if d.err == nil && precision != Float32 && precision != Float64 {
+		return nil, fmt.Errorf("unsupported precision: %d", precision)
+	}
+	header := d.header()
+	labels := d.words()
+	features := d.words()
+	if d.err != nil {
+		return nil, d.err
+	}
+	if err := features.set_header(header); err != nil {
+		return nil, fmt.Errorf("binary model format error: %v", err)
+	}
+
+	offsets := make([]uint64, labels.Size()+1)
+	for i, _ := range offsets {
+		offsets[i] = d.uint64()
+	}
+	nnz := offsets[len(offsets)-1]
+	if d.err != nil || nnz > uint64(len(d.data)) {
+		return nil, errBinaryFormat
+	}
+	ids := d.next(int(nnz) * 4)
+	values := d.next(int(nnz) * int(precision))
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	w := make([][]float64, labels.Size())
+	for label_id, _ := range w {
+		begin, end := offsets[label_id], offsets[label_id+1]
+		if begin > end || end > nnz {
+			return nil, fmt.Errorf("binary model format error: broken offsets of label %d", label_id)
+		}
+		if begin == end {
+			continue
+		}
+		// feature ids are ascending, so the last one decides the size
+		size := int64(binary.LittleEndian.Uint32(ids[(end-1)*4:])) + 1
+		if size > int64(features.Size()) {
+			return nil, fmt.Errorf("binary model format error: unknown feature id %d", size-1)
+		}
+		w[label_id] = make([]float64, size)
+		for i := begin; i < end; i++ {
+			feature_id := int64(binary.LittleEndian.Uint32(ids[i*4:]))
+			if feature_id >= size {
+				return nil, fmt.Errorf("binary model format error: feature ids of label %d are not sorted", label_id)
+			}
+			var v float64
+			if precision == Float32 {
+				v = float64(math.Float32frombits(binary.LittleEndian.Uint32(values[i*4:])))
+			} else {
+				v = math.Float64frombits(binary.LittleEndian.Uint64(values[i*8:]))
+			}
+			w[label_id][feature_id] = v
+		}
+	}
+	return new_predictor(labels, features, w), nil
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2014 TOKUNAGA Hiroyuki
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package rakai
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+// TestBinaryRoundTrip checks that a model saved with Float64 is restored
+// bit by bit.
+func TestBinaryRoundTrip(t *testing.T) {
+	cl := NewNBSVM(0.01, 0.1, 1.0e-8, true)
+	cl.SetBias(true)
+	if err := TrainDataset(cl, synthetic_dataset(500, 4, 1), 1); err != nil {
+		t.Fatal(err)
+	}
+	p := cl.Freeze()
+
+	var buf bytes.Buffer
+	if err := p.SaveBinary(&buf, Float64); err != nil {
+		t.Fatal(err)
+	}
+	q, err := LoadPredictor(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, wm := range [][2]*WordManager{{p.Labels, q.Labels}, {p.Features, q.Features}} {
+		if wm[0].Size() != wm[1].Size() {
+			t.Fatalf("size = %d, want %d", wm[1].Size(), wm[0].Size())
+		}
+		for id := 0; id < wm[0].Size(); id++ {
+			if wm[0].Word(int64(id)) != wm[1].Word(int64(id)) {
+				t.Errorf("word %d = %q, want %q", id, wm[1].Word(int64(id)), wm[0].Word(int64(id)))
+			}
+		}
+	}
+
+	check_weights(t, p, q)
+}
+
+// nonzero_weights returns the nonzero weights of p by label and feature.
+func nonzero_weights(p *Predictor) map[[2]string]float64 {
+	ret := make(map[[2]string]float64)
+	p.each_weight(func(label_id int, feature_id int64, v float64) {
+		ret[[2]string{p.Labels.Word(int64(label_id)), p.Features.Word(feature_id)}] = v
+	})
+	return ret
+}
+
+// check_weights checks that got has exactly the same weights as want.
+func check_weights(t *testing.T, want *Predictor, got *Predictor) {
+	w, g := nonzero_weights(want), nonzero_weights(got)
+	if len(g) != len(w) {
+		t.Errorf("%d nonzero weights, want %d", len(g), len(w))
+	}
+	for k, v := range w {
+		if math.Float64bits(g[k]) != math.Float64bits(v) {
+			t.Errorf("weight of %v = %v, want %v", k, g[k], v)
+		}
+	}
+}
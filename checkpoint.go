@@ -0,0 +1,129 @@
+// Copyright (c) 2014 TOKUNAGA Hiroyuki
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Checkpoints keep the full training state of a classifier, so that
+// training can be continued later with new data. Unlike Save, which
+// writes only nonzero weights, a checkpoint has counts, last update
+// times, states of learning rate schedules and so on. A checkpoint is a
+// header followed by the classifier, both encoded by encoding/gob.
+
+package rakai
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	checkpoint_magic   = "rakai checkpoint"
+	checkpoint_version = 1
+)
+
+type checkpoint_header struct {
+	Magic   string
+	Version int
+}
+
+func init() {
+	gob.Register(&NBSVM{})
+	gob.Register(&Perceptron{})
+	gob.Register(&AveragedPerceptron{})
+	gob.Register(&PassiveAggressive{})
+	gob.Register(&ConfidenceWeighted{})
+	gob.Register(&LogisticRegression{})
+	gob.Register(&FTRL{})
+
+	gob.Register(&Constant{})
+	gob.Register(&InverseScaling{})
+	gob.Register(&ExponentialDecay{})
+	gob.Register(&AdaGrad{})
+	gob.Register(&legacy_adagrad{})
+	gob.Register(&RMSProp{})
+	gob.Register(&Adam{})
+}
+
+// SaveCheckpoint writes the full training state of cl, which can be read
+// by LoadCheckpoint to continue training.
+func SaveCheckpoint(w io.Writer, cl Classifier) error {
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(checkpoint_header{checkpoint_magic, checkpoint_version}); err != nil {
+		return err
+	}
+	return enc.Encode(&cl)
+}
+
+// LoadCheckpoint reads a checkpoint written by SaveCheckpoint, and
+// returns the classifier in the same state.
+func LoadCheckpoint(r io.Reader) (Classifier, error) {
+	dec := gob.NewDecoder(r)
+
+	var h checkpoint_header
+	if err := dec.Decode(&h); err != nil || h.Magic != checkpoint_magic {
+		return nil, fmt.Errorf("not a checkpoint")
+	}
+	if h.Version != checkpoint_version {
+		return nil, fmt.Errorf("unsupported checkpoint version %d", h.Version)
+	}
+
+	var cl Classifier
+	if err := dec.Decode(&cl); err != nil {
+		return nil, fmt.Errorf("checkpoint format error: %v", err)
+	}
+	return cl, nil
+}
+
+// SaveCheckpointFile saves the checkpoint of cl into filename.
+func SaveCheckpointFile(cl Classifier, filename string) error {
+	fi, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	if err := SaveCheckpoint(fi, cl); err != nil {
+		fi.Close()
+		return err
+	}
+	return fi.Close()
+}
+
+func LoadCheckpointFile(filename string) (Classifier, error) {
+	fi, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	return LoadCheckpoint(fi)
+}
+
+// gob_encode and gob_decode are helpers for GobEncode and GobDecode
+// methods, which encode unexported fields via state structs.
+func gob_encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func gob_decode(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
@@ -22,10 +22,9 @@ package rakai
 
 import (
 	"bufio"
-	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math"
 	"os"
 	"sort"
 	"strconv"
@@ -44,23 +43,60 @@ type FVS struct {
 	V float64
 }
 
+// BiasFeature is the feature which is added to every example when bias
+// is enabled. Its weights are the per-class bias terms, and they are
+// saved as ordinary weights, so a model which has this feature is
+// loaded as a model with bias.
+const BiasFeature = "__BIAS__"
+
+// Prediction is a result of Predict. RunnerUp is the label with the
+// second highest score, and Margin is the difference of the scores.
+type Prediction struct {
+	Label    string  `json:"label"`
+	Score    float64 `json:"score"`
+	RunnerUp string  `json:"runner_up"`
+	Margin   float64 `json:"margin"`
+}
+
 type Classifier interface {
-	// returns label_id, score, margin
-	predict_id([]FV) (int, float64, int, float64)
-	predict([]FVS) (string, float64)
-	train1(string, []FVS)
-	Save(string)
+	// returns label_id, score, runner-up label_id, margin
+	PredictID([]FV) (int, float64, int, float64)
+	Predict([]FVS) Prediction
+	Train(string, []FVS)
+	Save(io.Writer) error
+	// Freeze returns a Predictor with a copy of the weights. The
+	// Predictor is safe for concurrent use, and is not affected by
+	// further training.
+	Freeze() *Predictor
+	// SetBias enables or disables the per-class bias. Call it before
+	// training. Features passed to PredictID should include BiasFeature
+	// if bias is enabled, Predict and Train add it automatically.
+	SetBias(bool)
 }
 
+// Predictor is a read-only classifier, loaded from a model file or
+// frozen from a Classifier. It is safe for concurrent use by multiple
+// goroutines.
 type Predictor struct {
 	Labels   *WordManager
 	Features *WordManager
 	w        [][]float64
+	bias_id  int64
+	mapped   *mapped_weights // weights of a mapped model, used instead of w
+	release  func() error    // unmaps the model, see Close
 }
 
 type WordManager struct {
 	word2id map[string]int64
 	id2word []string
+	table   *word_table // read-only words of a mapped model, or nil
+
+	// words are hashed into 2^hash_bits ids, if hash_bits > 0
+	hash_bits int
+	hash_seed uint32
+
+	// other model header entries, which describe how features are made
+	info map[string]string
 }
 
 func (wm *WordManager) add_word(word string) int64 {
@@ -70,7 +106,17 @@ func (wm *WordManager) add_word(word string) int64 {
 	return new_id
 }
 
+// get_word returns the id of word. If word is unknown, it is added if
+// update is true, or -1 is returned. Words of a mapped model are never
+// added, and words of a hashed WordManager are always known.
 func (wm *WordManager) get_word(word string, update bool) int64 {
+	if wm.table != nil {
+		return wm.table.find(word)
+	}
+	if wm.hashed() {
+		id, _ := wm.hash(word)
+		return id
+	}
 	id, ok := wm.word2id[word]
 
 	if ok {
@@ -83,6 +129,112 @@ func (wm *WordManager) get_word(word string, update bool) int64 {
 	return -1
 }
 
+// ID returns the id of word, or -1 if word is unknown. For a hashed
+// WordManager, it is the bucket of word.
+func (wm *WordManager) ID(word string) int64 {
+	return wm.get_word(word, false)
+}
+
+// Word returns the word of id. For a hashed WordManager, it is the id
+// itself in decimal, since words are not stored.
+func (wm *WordManager) Word(id int64) string {
+	if wm.table != nil {
+		return string(wm.table.bytes(int(id)))
+	}
+	if wm.hashed() {
+		if id == wm.bias_bucket() {
+			return BiasFeature
+		}
+		return strconv.FormatInt(id, 10)
+	}
+	return wm.id2word[id]
+}
+
+// Size returns the number of known words, or the number of ids of a
+// hashed WordManager.
+func (wm *WordManager) Size() int {
+	if wm.table != nil {
+		return wm.table.n
+	}
+	if wm.hashed() {
+		return int(wm.bias_bucket()) + 1
+	}
+	return len(wm.id2word)
+}
+
+func (wm *WordManager) clone() *WordManager {
+	if wm.table != nil || wm.hashed() {
+		// read-only, so it can be shared
+		return wm
+	}
+	c := NewWordManager()
+	c.info = wm.info
+	for word, id := range wm.word2id {
+		c.word2id[word] = id
+	}
+	c.id2word = append(c.id2word, wm.id2word...)
+	return c
+}
+
+// word_manager_state is the state of WordManager in a checkpoint.
+type word_manager_state struct {
+	Words    []string
+	HashBits int
+	HashSeed uint32
+	Info     map[string]string
+}
+
+func (wm *WordManager) GobEncode() ([]byte, error) {
+	return gob_encode(word_manager_state{wm.id2word, wm.hash_bits, wm.hash_seed, wm.info})
+}
+
+func (wm *WordManager) GobDecode(data []byte) error {
+	var s word_manager_state
+	if err := gob_decode(data, &s); err != nil {
+		return err
+	}
+	*wm = *NewHashedWordManager(s.HashBits, s.HashSeed)
+	wm.info = s.Info
+	for _, word := range s.Words {
+		wm.add_word(word)
+	}
+	return nil
+}
+
+// header returns the model header entries to restore the settings of
+// wm, that is, feature hashing and how features are made.
+func (wm *WordManager) header() map[string]string {
+	header := make(map[string]string)
+	for key, value := range wm.info {
+		header[key] = value
+	}
+	if wm.hashed() {
+		header["hash_bits"] = strconv.Itoa(wm.hash_bits)
+		header["hash_seed"] = strconv.FormatUint(uint64(wm.hash_seed), 10)
+	}
+	return header
+}
+
+// set_header restores the settings of wm from a model header.
+func (wm *WordManager) set_header(header map[string]string) error {
+	for key, value := range header {
+		if key != "hash_bits" && key != "hash_seed" {
+			wm.set_info(key, value)
+		}
+	}
+	if _, ok := header["hash_bits"]; ok {
+		return wm.set_hash_header(header)
+	}
+	return nil
+}
+
+func (wm *WordManager) set_info(key string, value string) {
+	if wm.info == nil {
+		wm.info = make(map[string]string)
+	}
+	wm.info[key] = value
+}
+
 func NewWordManager() *WordManager {
 	var wm WordManager
 	wm.word2id = make(map[string]int64)
@@ -92,18 +244,76 @@ func NewWordManager() *WordManager {
 
 func fvs2fv(wm *WordManager, fvs []FVS, update bool) []FV {
 	ret := make([]FV, 0, len(fvs))
+	if wm.hashed() {
+		for _, x := range fvs {
+			k, sign := wm.hash(x.K)
+			ret = append(ret, FV{k, sign * x.V})
+		}
+		return ret
+	}
 	for _, x := range fvs {
-		k, ok := wm.word2id[x.K]
-		if ok {
-			ret = append(ret, FV{k, x.V})
-		} else if update {
-			k = wm.add_word(x.K)
+		if k := wm.get_word(x.K, update); k >= 0 {
 			ret = append(ret, FV{k, x.V})
 		}
 	}
 	return ret
 }
 
+// append_bias appends the bias feature to fv, if bias_id is valid.
+func append_bias(fv []FV, bias_id int64) []FV {
+	if bias_id < 0 {
+		return fv
+	}
+	return append(fv, FV{bias_id, 1.0})
+}
+
+// new_bias_id returns the id of BiasFeature if enable is true, and -1
+// otherwise.
+func new_bias_id(features *WordManager, enable bool) int64 {
+	if !enable {
+		return -1
+	}
+	return features.get_word(BiasFeature, true)
+}
+
+// best_two returns the id and the score of the best label, the id of
+// the runner-up label, and the margin between them, where score(i)
+// returns the score of label i. If there is only one label, the
+// runner-up is the best label itself and the margin is +Inf.
+func best_two(n int, score func(i int) float64) (int, float64, int, float64) {
+	if n == 0 {
+		return 0, 0.0, 0, 0.0
+	}
+	id := 0
+	second_id := 0
+	max_score := math.Inf(-1)
+	second_score := math.Inf(-1)
+	for i := 0; i < n; i++ {
+		score := score(i)
+		if score > max_score {
+			second_id = id
+			second_score = max_score
+			max_score = score
+			id = i
+		} else if score > second_score {
+			second_id = i
+			second_score = score
+		}
+	}
+	return id, max_score, second_id, max_score - second_score
+}
+
+func make_prediction(labels *WordManager, id int, score float64, second_id int, margin float64) Prediction {
+	if len(labels.id2word) == 0 {
+		return Prediction{}
+	}
+	if math.IsInf(margin, 1) {
+		// no runner-up
+		return Prediction{labels.id2word[id], score, "", 0.0}
+	}
+	return Prediction{labels.id2word[id], score, labels.id2word[second_id], margin}
+}
+
 func ensure_w(w []float64, k int64) []float64 {
 	for len(w) < int(k)+1 {
 		w = append(w, 0.0)
@@ -123,187 +333,352 @@ func product(w []float64, fv []FV) float64 {
 	return ret
 }
 
-func parse_line(s string) (string, []FVS, error) {
-	content := make([]FVS, 0)
-	s = strings.TrimRight(s, "\n")
-	s = strings.TrimRight(s, "\r")
-	ss := strings.Split(s, " ")
-	label := ss[0]
-	for i := 1; i < len(ss); i++ {
-		e := strings.Split(ss[i], ":")
-
-		if len(e) != 2 {
-			if len(e) != 1 {
-				// TODO: proper error message generation
-				fmt.Println("element size wrong")
-				return "", content, errors.New("parse failed")
-			}
-		} else {
-			k := e[0]
-			v, _ := strconv.ParseFloat(e[1], 64)
-			content = append(content, FVS{k, v})
-		}
-	}
-	return label, content, nil
-}
-
-func TrainFile(cl Classifier, filename string) error {
-	fi, err := os.Open(filename)
-
-	defer func() {
-		if err := fi.Close(); err != nil {
-			panic(err)
-		}
-	}()
-
-	if err != nil {
-		return err
-	}
-
-	reader := bufio.NewReaderSize(fi, 4096*64)
+func TrainReader(cl Classifier, er *ExampleReader) error {
 	for {
-		line, _, err := reader.ReadLine()
+		label, dat, err := er.Next()
 		if err == io.EOF {
 			break
 		}
-
-		label, dat, err := parse_line(string(line))
-
 		if err != nil {
-			fmt.Println("err:", err)
+			return err
 		}
-		cl.train1(label, dat)
+		cl.Train(label, dat)
 	}
 	return nil
 }
 
+// TrainFile trains cl with filename with threads goroutines, and
+// returns the number of skipped lines in lenient mode.
+func TrainFile(cl Classifier, filename string, mode ParseMode, threads int) (int, error) {
+	fi, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer fi.Close()
+
+	er := NewExampleReader(fi, filename, mode)
+	err = TrainParallel(cl, er, threads)
+	return er.Skipped, err
+}
+
 type stats struct {
 	tp int64
 	fp int64
 	fn int64
 }
 
-func TestFile(cl *Predictor, filename string) (map[string]stats, error) {
-	st := make(map[string]stats)
+func add_result(st map[string]stats, label string, predicted string) {
+	s1, ok := st[label]
+	if !ok {
+		st[label] = stats{}
+	}
 
-	fi, err := os.Open(filename)
+	if label == predicted {
+		s1 := st[label]
+		s1.tp += 1
+		st[label] = s1
+	} else {
+		s1.fn += 1
+		st[label] = s1
+
+		s2 := st[predicted]
+		s2.fp += 1
+		st[predicted] = s2
+	}
+}
 
-	defer func() {
-		if err := fi.Close(); err != nil {
-			panic(err)
-		}
-	}()
+// TestReader predicts examples of er with workers goroutines, and
+// returns the statistics.
+func TestReader(cl *Predictor, er *ExampleReader, workers int) (map[string]stats, error) {
+	st := make(map[string]stats)
+
+	err := predict_reader(cl, er, workers, func(label string, pr Prediction) error {
+		add_result(st, label, pr.Label)
+		return nil
+	}, nil, nil)
 
 	if err != nil {
 		return nil, err
 	}
+	return st, nil
+}
 
-	reader := bufio.NewReaderSize(fi, 4096*64)
-	for {
-		line, _, err := reader.ReadLine()
-
-		if err == io.EOF {
-			break
-		}
+// TestFile tests cl with filename, and returns the statistics and the
+// number of skipped lines in lenient mode.
+func TestFile(cl *Predictor, filename string, mode ParseMode, workers int) (map[string]stats, int, error) {
+	fi, err := os.Open(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer fi.Close()
 
-		label, dat, err := parse_line(string(line))
+	er := NewExampleReader(fi, filename, mode)
+	st, err := TestReader(cl, er, workers)
+	return st, er.Skipped, err
+}
 
-		predicted, _ := cl.predict(dat)
+// TestDataset predicts examples of d with workers goroutines, and
+// returns the statistics.
+func TestDataset(cl *Predictor, d *Dataset, workers int) map[string]stats {
+	batch := make([][]FVS, len(d.Examples))
+	for i, x := range d.Examples {
+		batch[i] = x.Features
+	}
 
-		s1, ok := st[label]
-		if !ok {
-			st[label] = stats{}
-		}
+	st := make(map[string]stats)
+	for i, pr := range cl.PredictBatch(batch, workers) {
+		add_result(st, d.Examples[i].Label, pr.Label)
+	}
+	return st
+}
 
-		if label == predicted {
-			s1 := st[label]
-			s1.tp += 1
-			st[label] = s1
+// PredictStream reads examples from er and writes one prediction per
+// line to writer, in the form "label\tscore". If runner_up is true, the
+// runner-up label and the margin are appended as
+// "label\tscore\trunner_up\tmargin". A line skipped in lenient mode is
+// written with all fields empty ("\t", or "\t\t\t" with runner_up), so
+// that output lines correspond to non-empty input lines. Examples are parsed and predicted with workers
+// goroutines, the output keeps the input order. Output is flushed
+// whenever the input has no more buffered data, so it can be used in a
+// pipe.
+func PredictStream(p *Predictor, er *ExampleReader, writer io.Writer, runner_up bool, workers int) error {
+	w := bufio.NewWriterSize(writer, 4096*32)
+
+	err := predict_reader(p, er, workers, func(_ string, pr Prediction) error {
+		var err error
+		if runner_up {
+			_, err = fmt.Fprintf(w, "%s\t%f\t%s\t%f\n", pr.Label, pr.Score, pr.RunnerUp, pr.Margin)
 		} else {
-			s1.fn += 1
-			st[label] = s1
-
-			s2 := st[predicted]
-			s2.fp += 1
-			st[predicted] = s2
+			_, err = fmt.Fprintf(w, "%s\t%f\n", pr.Label, pr.Score)
+		}
+		return err
+	}, func() error {
+		skipped := "\t\n"
+		if runner_up {
+			skipped = "\t\t\t\n"
 		}
+		_, err := w.WriteString(skipped)
+		return err
+	}, w.Flush)
+
+	if err != nil {
+		// keep the predictions of the lines before the error
+		w.Flush()
+		return err
 	}
+	return w.Flush()
+}
 
-	return st, nil
+func (p *Predictor) PredictID(fv []FV) (int, float64, int, float64) {
+	if p.mapped != nil {
+		scores := p.mapped.scores(fv, p.Labels.Size())
+		return best_two(len(scores), func(i int) float64 {
+			return scores[i]
+		})
+	}
+	return best_two(len(p.w), func(i int) float64 {
+		return product(p.w[i], fv)
+	})
 }
 
-func (p *Predictor) predict_id(fv []FV) (int, float64, int, float64) {
-	id := 0
-	second_id := 0
-	// TODO: fix -10000.0
-	max_score := -10000.0
-	second_score := -10000.0
+// PredictProba returns the softmax of the scores of each label, the
+// i-th element is for Labels.Word(i). It is a probability distribution
+// if the model is trained by LogisticRegression.
+func (p *Predictor) PredictProba(fvs []FVS) []float64 {
+	fv := append_bias(fvs2fv(p.Features, fvs, false), p.bias_id)
+	if p.mapped != nil {
+		return softmax(p.mapped.scores(fv, p.Labels.Size()))
+	}
+	scores := make([]float64, len(p.Labels.id2word))
 	for i, w := range p.w {
-		score := product(w, fv)
-		if score > max_score {
-			second_id = id
-			second_score = max_score
-			max_score = score
-			id = i
-		} else if score > second_score {
-			second_id = id
-			second_score = score
-		}
+		scores[i] = product(w, fv)
 	}
-	return id, max_score, second_id, max_score - second_score
+	return softmax(scores)
 }
 
-func (p *Predictor) predict(fvs []FVS) (string, float64) {
-	fv := fvs2fv(p.Features, fvs, false)
-	id, score, _, _ := p.predict_id(fv)
-	return p.Labels.id2word[id], score
+func (p *Predictor) Predict(fvs []FVS) Prediction {
+	fv := append_bias(fvs2fv(p.Features, fvs, false), p.bias_id)
+	id, score, second_id, margin := p.PredictID(fv)
+	return make_prediction(p.Labels, id, score, second_id, margin)
 }
 
-func NewPredictor(filename string) *Predictor {
-	var p Predictor
+// Save writes the weights in the same format as the classifier which
+// the Predictor is frozen from.
+func (p *Predictor) Save(w io.Writer) error {
+	return save_tsv(w, p.Labels, p.Features, p.each_weight)
+}
 
-	p.Labels = NewWordManager()
-	p.Features = NewWordManager()
-	p.w = make([][]float64, 0)
+// each_weight calls fn for each nonzero weight, label by label in
+// ascending order of feature ids. The weights of a mapped model are
+// read sparsely, and never decoded into a dense matrix.
+func (p *Predictor) each_weight(fn func(label_id int, feature_id int64, v float64)) {
+	if p.mapped != nil {
+		p.mapped.rows(p.Labels.Size(), p.Features.Size()).each(fn)
+		return
+	}
+	each_dense(p.w, fn)
+}
 
-	fi, err := os.Open(filename)
-	if err != nil {
-		log.Fatal(err)
+// each_dense calls fn for each nonzero element of weights, row by row.
+func each_dense(weights [][]float64, fn func(label_id int, feature_id int64, v float64)) {
+	for label_id, values := range weights {
+		for feature_id, v := range values {
+			if v != 0.0 {
+				fn(label_id, int64(feature_id), v)
+			}
+		}
 	}
+}
 
-	defer func() {
-		if err := fi.Close(); err != nil {
-			panic(err)
+func new_predictor(labels *WordManager, features *WordManager, w [][]float64) *Predictor {
+	var p Predictor
+	p.Labels = labels
+	p.Features = features
+	p.w = w
+	p.bias_id = features.get_word(BiasFeature, false)
+	return &p
+}
+
+// LoadPredictor reads a model written by Save, SaveBinary or SaveMmap.
+// The format is detected automatically. A model of the mmap format is
+// read into memory, use NewPredictor or OpenMmap to map it.
+func LoadPredictor(r io.Reader) (*Predictor, error) {
+	reader := bufio.NewReaderSize(r, 4096*64)
+	if is_binary(reader) {
+		return load_binary(reader)
+	}
+	if is_mmap(reader) {
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, err
 		}
-	}()
+		return parse_mmap(data)
+	}
+	return load_tsv(reader)
+}
 
-	reader := bufio.NewReaderSize(fi, 4096*64)
-	for {
-		line, _, err := reader.ReadLine()
+// load_tsv reads a model in the format of Save.
+func load_tsv(reader *bufio.Reader) (*Predictor, error) {
+	p := new_predictor(NewWordManager(), NewWordManager(), make([][]float64, 0))
+	header := make(map[string]string)
 
+	for n := 1; ; n++ {
+		s, err := read_line(reader)
 		if err == io.EOF {
 			break
 		}
+		if err != nil {
+			return nil, err
+		}
 
-		s := strings.TrimRight(string(line), "\n")
-		s = strings.TrimRight(s, "\r")
 		ss := strings.Split(s, "\t")
 
 		if len(ss) != 3 {
-			fmt.Println("model file format error")
-			os.Exit(1)
+			return nil, fmt.Errorf("model file format error at line %d: %d columns, expected 3", n, len(ss))
+		}
+
+		if ss[0] == header_mark {
+			if p.Labels.Size() > 0 {
+				return nil, fmt.Errorf("model file format error at line %d: header after weights", n)
+			}
+			header[ss[1]] = ss[2]
+			continue
+		}
+		if p.Labels.Size() == 0 && len(header) > 0 {
+			if err := p.Features.set_header(header); err != nil {
+				return nil, fmt.Errorf("model file format error: %v", err)
+			}
 		}
 
 		label := ss[0]
 		feature := ss[1]
-		v, _ := strconv.ParseFloat(ss[2], 64)
+		v, err := strconv.ParseFloat(ss[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("model file format error at line %d: %v", n, err)
+		}
 		label_id := p.Labels.get_word(label, true)
-		feature_id := p.Features.get_word(feature, true)
-		//		fmt.Println(label_id, feature_id, v)
-		add_weight(&p, label_id, feature_id, v)
+		feature_id, err := p.Features.load_word(feature)
+		if err != nil {
+			return nil, fmt.Errorf("model file format error at line %d: %v", n, err)
+		}
+		add_weight(p, label_id, feature_id, v)
 	}
+	p.bias_id = p.Features.get_word(BiasFeature, false)
 
-	return &p
+	return p, nil
+}
+
+// NewPredictor loads a model from filename. A model of the mmap format
+// is mapped, see OpenMmap.
+func NewPredictor(filename string) (*Predictor, error) {
+	fi, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	reader := bufio.NewReaderSize(fi, 4096*64)
+	if is_mmap(reader) {
+		return OpenMmap(filename)
+	}
+	return LoadPredictor(reader)
+}
+
+// header_mark is the label of model header lines of the TSV format,
+// "#rakai\tkey\tvalue", which precede weights.
+const header_mark = "#rakai"
+
+func header_keys(header map[string]string) []string {
+	keys := make([]string, 0, len(header))
+	for key, _ := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// save_weights writes nonzero weights in the model format, that is,
+// "label\tfeature\tweight" per line.
+func save_weights(w io.Writer, labels *WordManager, features *WordManager, weights [][]float64) error {
+	return save_tsv(w, labels, features, func(fn func(int, int64, float64)) {
+		each_dense(weights, fn)
+	})
+}
+
+// save_tsv writes the weights given by each in the model format. each
+// calls its argument for each nonzero weight.
+func save_tsv(w io.Writer, labels *WordManager, features *WordManager, each func(func(int, int64, float64))) error {
+	writer := bufio.NewWriterSize(w, 4096*32)
+
+	header := features.header()
+	for _, key := range header_keys(header) {
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", header_mark, key, header[key])
+	}
+
+	each(func(label_id int, feature_id int64, v float64) {
+		fmt.Fprintf(writer, "%s\t%s\t%2.4f\n", labels.id2word[label_id], features.Word(feature_id), v)
+	})
+	return writer.Flush()
+}
+
+// Saver is a model which can be saved, that is, a Classifier or a
+// Predictor.
+type Saver interface {
+	Save(w io.Writer) error
+}
+
+// SaveFile saves cl into filename.
+func SaveFile(cl Saver, filename string) error {
+	fi, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	if err := cl.Save(fi); err != nil {
+		fi.Close()
+		return err
+	}
+	return fi.Close()
 }
 
 func add_weight(p *Predictor, label_id int64, feature_id int64, v float64) {
@@ -351,3 +726,19 @@ func CalcAccuracy(m map[string]stats) (float64, int, int) {
 	acc := float64(num_true) / (float64(num_false)/2.0 + float64(num_true))
 	return acc, num_true, num_false / 2.0
 }
+
+// CalcMacroF1 returns the unweighted mean of F1 scores of all labels.
+func CalcMacroF1(m map[string]stats) float64 {
+	if len(m) == 0 {
+		return 0.0
+	}
+	sum := 0.0
+	for _, v := range m {
+		p := CalcPrecision(v)
+		r := CalcRecall(v)
+		if p+r > 0.0 {
+			sum += 2.0 * p * r / (p + r)
+		}
+	}
+	return sum / float64(len(m))
+}
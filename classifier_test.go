@@ -0,0 +1,170 @@
+// Copyright (c) 2014 TOKUNAGA Hiroyuki
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package rakai
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// synthetic_dataset returns n examples of n_labels labels. Each example
+// has 3 of the 5 features of its label and 5 noise features shared by
+// all labels, so the classes are linearly separable.
+func synthetic_dataset(n int, n_labels int, seed int64) *Dataset {
+	rng := rand.New(rand.NewSource(seed))
+	d := NewDataset()
+	for i := 0; i < n; i++ {
+		label := rng.Intn(n_labels)
+		fvs := make([]FVS, 0)
+		for _, j := range rng.Perm(5)[:3] {
+			fvs = append(fvs, FVS{fmt.Sprintf("l%d_f%d", label, j), 1.0})
+		}
+		for j := 0; j < 5; j++ {
+			fvs = append(fvs, FVS{fmt.Sprintf("noise%d", rng.Intn(50)), 1.0})
+		}
+		d.Examples = append(d.Examples, Example{fmt.Sprintf("label%d", label), fvs})
+	}
+	return d
+}
+
+func accuracy(p *Predictor, d *Dataset) float64 {
+	acc, _, _ := CalcAccuracy(TestDataset(p, d, 1))
+	return acc
+}
+
+// TestConcurrentPredict checks that a frozen Predictor and the read-only
+// PredictID of NBSVM can be used by many goroutines at once. Run it with
+// go test -race.
+func TestConcurrentPredict(t *testing.T) {
+	train := synthetic_dataset(1000, 4, 1)
+	test := synthetic_dataset(200, 4, 2)
+	cl := NewNBSVM(0.01, 0.1, 1.0e-8, true)
+	for i := 0; i < 3; i++ {
+		if err := TrainDataset(cl, train, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := cl.Freeze()
+
+	want := make([]Prediction, len(test.Examples))
+	fvs := make([][]FV, len(test.Examples))
+	for i, e := range test.Examples {
+		want[i] = p.Predict(e.Features)
+		fvs[i] = fvs2fv(cl.Features, e.Features, false)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan string, 16)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i, e := range test.Examples {
+				if got := p.Predict(e.Features); got != want[i] {
+					errs <- fmt.Sprintf("Predict(%d) = %v, want %v", i, got, want[i])
+					return
+				}
+				cl.PredictID(fvs[i])
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for msg := range errs {
+		t.Error(msg)
+	}
+
+	if acc := accuracy(p, test); acc < 0.95 {
+		t.Errorf("accuracy = %f, want >= 0.95", acc)
+	}
+}
+
+// TestPredictStreamStrict checks that predictions of the lines before a
+// broken line are written in strict mode.
+func TestPredictStreamStrict(t *testing.T) {
+	cl := NewNBSVM(0.01, 0.1, 1.0e-8, true)
+	if err := TrainDataset(cl, synthetic_dataset(200, 3, 1), 1); err != nil {
+		t.Fatal(err)
+	}
+	input := strings.Repeat("label0 l0_f0:1\n", 5) + "label0 l0_f0:zz\nlabel0 l0_f1:1\n"
+
+	var out bytes.Buffer
+	er := NewExampleReader(strings.NewReader(input), "input", Strict)
+	err := PredictStream(cl.Freeze(), er, &out, false, 2)
+	var perr *ParseError
+	if !errors.As(err, &perr) || perr.Line != 6 {
+		t.Fatalf("error = %v, want a ParseError at line 6", err)
+	}
+	if n := strings.Count(out.String(), "\n"); n != 5 {
+		t.Errorf("%d lines of output, want 5:\n%s", n, out.String())
+	}
+}
+
+// TestBestTwo checks that best_two works for any scores, including very
+// low ones, and for fewer than two labels.
+func TestBestTwo(t *testing.T) {
+	cases := []struct {
+		scores    []float64
+		id        int
+		second_id int
+		margin    float64
+	}{
+		{[]float64{-3e6, -1e6, -2e6}, 1, 2, 1e6},
+		{[]float64{1.0, 3.0, 2.0}, 1, 2, 1.0},
+		{[]float64{2.0, 1.0}, 0, 1, 1.0},
+		{[]float64{-5e6}, 0, 0, math.Inf(1)},
+	}
+	for _, c := range cases {
+		id, score, second_id, margin := best_two(len(c.scores), func(i int) float64 {
+			return c.scores[i]
+		})
+		if id != c.id || score != c.scores[c.id] || second_id != c.second_id || margin != c.margin {
+			t.Errorf("best_two(%v) = %d, %v, %d, %v, want %d, %v, %d, %v",
+				c.scores, id, score, second_id, margin, c.id, c.scores[c.id], c.second_id, c.margin)
+		}
+	}
+}
+
+// TestPredictStreamLenient checks that a skipped line is written as a
+// line of empty fields.
+func TestPredictStreamLenient(t *testing.T) {
+	cl := NewNBSVM(0.01, 0.1, 1.0e-8, true)
+	if err := TrainDataset(cl, synthetic_dataset(200, 3, 1), 1); err != nil {
+		t.Fatal(err)
+	}
+	input := "label0 l0_f0:1\nlabel0 l0_f0:zz\nlabel1 l1_f1:1\n"
+
+	var out bytes.Buffer
+	er := NewExampleReader(strings.NewReader(input), "input", Lenient)
+	if err := PredictStream(cl.Freeze(), er, &out, false, 1); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(out.String(), "\n")
+	if len(lines) != 4 || lines[1] != "\t" || !strings.HasPrefix(lines[2], "label1\t") {
+		t.Errorf("output = %q", out.String())
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright (c) 2014 TOKUNAGA Hiroyuki
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Confidence-weighted learners: AROW and Soft Confidence-Weighted
+// learning (SCW-I and SCW-II). Each weight has a mean and a variance
+// (diagonal covariance), and the update is smaller for the weights
+// which the learner is confident of. Only the means are saved as a
+// model, the covariance is kept while training goes on.
+// See K. Crammer, A. Kulesza and M. Dredze, "Adaptive Regularization of
+// Weight Vectors", NIPS 2009, and J. Wang, P. Zhao and S. C. H. Hoi,
+// "Exact Soft Confidence-Weighted Learning", ICML 2012.
+
+package rakai
+
+import (
+	"io"
+	"math"
+)
+
+type CWType int
+
+const (
+	AROW CWType = iota
+	SCW1
+	SCW2
+)
+
+type ConfidenceWeighted struct {
+	Labels   *WordManager
+	Features *WordManager
+	mu       [][]float64 // mean
+	sigma    [][]float64 // diagonal covariance
+	variant  CWType
+	r        float64 // regularization parameter of AROW
+	c        float64 // aggressiveness parameter of SCW
+	phi      float64 // inverse of the normal CDF of the confidence
+	t        int64
+	bias_id  int64 // -1 if bias is disabled
+}
+
+func new_confidence_weighted(variant CWType) *ConfidenceWeighted {
+	var p ConfidenceWeighted
+
+	p.Labels = NewWordManager()
+	p.Features = NewWordManager()
+	p.mu = make([][]float64, 0)
+	p.sigma = make([][]float64, 0)
+	p.variant = variant
+	p.t = 0
+	p.bias_id = -1
+	return &p
+}
+
+// NewAROW returns an AROW learner. r is the regularization parameter,
+// smaller r makes larger updates.
+func NewAROW(r float64) *ConfidenceWeighted {
+	p := new_confidence_weighted(AROW)
+	p.r = r
+	return p
+}
+
+// NewSCW returns an SCW-I (variant is SCW1) or SCW-II (variant is SCW2)
+// learner. c is the aggressiveness parameter, and confidence (0.5 to 1)
+// is the probability that an example should be classified correctly.
+func NewSCW(variant CWType, c float64, confidence float64) *ConfidenceWeighted {
+	p := new_confidence_weighted(variant)
+	p.c = c
+	p.phi = math.Sqrt2 * math.Erfinv(2.0*confidence-1.0)
+	return p
+}
+
+func (p *ConfidenceWeighted) SetBias(enable bool) {
+	p.bias_id = new_bias_id(p.Features, enable)
+}
+
+func (p *ConfidenceWeighted) words() (*WordManager, *WordManager) {
+	return p.Labels, p.Features
+}
+
+func (p *ConfidenceWeighted) PredictID(fv []FV) (int, float64, int, float64) {
+	return best_two(len(p.mu), func(i int) float64 {
+		return product(p.mu[i], fv)
+	})
+}
+
+func (p *ConfidenceWeighted) Predict(fvs []FVS) Prediction {
+	fv := append_bias(fvs2fv(p.Features, fvs, false), p.bias_id)
+	id, score, second_id, margin := p.PredictID(fv)
+	return make_prediction(p.Labels, id, score, second_id, margin)
+}
+
+func (p *ConfidenceWeighted) ensure_label(label_id int) {
+	for len(p.mu) < label_id+1 {
+		p.mu = append(p.mu, make([]float64, 0))
+		p.sigma = append(p.sigma, make([]float64, 0))
+	}
+}
+
+// ensure_sigma extends s up to k, initial variance is 1.
+func ensure_sigma(s []float64, k int64) []float64 {
+	for len(s) < int(k)+1 {
+		s = append(s, 1.0)
+	}
+	return s
+}
+
+// variance returns x^T Sigma x for label_id.
+func (p *ConfidenceWeighted) variance(label_id int, fv []FV) float64 {
+	v := 0.0
+	for _, x := range fv {
+		s := 1.0
+		if int(x.K) < len(p.sigma[label_id]) {
+			s = p.sigma[label_id][x.K]
+		}
+		v += s * x.V * x.V
+	}
+	return v
+}
+
+// step returns alpha (step size of the mean) and beta (step size of the
+// covariance), for margin m and variance v.
+func (p *ConfidenceWeighted) step(m float64, v float64) (float64, float64) {
+	switch p.variant {
+	case AROW:
+		if m >= 1.0 {
+			return 0.0, 0.0
+		}
+		beta := 1.0 / (v + p.r)
+		return (1.0 - m) * beta, beta
+	default:
+		phi := p.phi
+		if phi*math.Sqrt(v)-m <= 0.0 {
+			return 0.0, 0.0
+		}
+		psi := 1.0 + phi*phi/2.0
+		zeta := 1.0 + phi*phi
+
+		var alpha float64
+		if p.variant == SCW1 {
+			alpha = (-m*psi + math.Sqrt(m*m*phi*phi*phi*phi/4.0+v*phi*phi*zeta)) / (v * zeta)
+			alpha = math.Min(p.c, math.Max(0.0, alpha))
+		} else {
+			n := v + 1.0/(2.0*p.c)
+			gamma := phi * math.Sqrt(phi*phi*m*m*v*v+4.0*n*v*(n+v*phi*phi))
+			alpha = (-(2.0*m*n + phi*phi*m*v) + gamma) / (2.0 * (n*n + n*v*phi*phi))
+			alpha = math.Max(0.0, alpha)
+		}
+		if alpha == 0.0 {
+			return 0.0, 0.0
+		}
+		u := -alpha*v*phi + math.Sqrt(alpha*alpha*v*v*phi*phi+4.0*v)
+		u = u * u / 4.0
+		beta := alpha * phi / (math.Sqrt(u) + v*alpha*phi)
+		return alpha, beta
+	}
+}
+
+func (p *ConfidenceWeighted) Train(label string, fvs []FVS) {
+	true_id := int(p.Labels.get_word(label, true))
+	fv := append_bias(fvs2fv(p.Features, fvs, true), p.bias_id)
+	p.t++
+
+	p.ensure_label(len(p.Labels.id2word) - 1)
+
+	// the highest scoring wrong label
+	wrong_id := -1
+	wrong_score := math.Inf(-1)
+	for i := 0; i < len(p.mu); i++ {
+		if i == true_id {
+			continue
+		}
+		if s := product(p.mu[i], fv); s > wrong_score {
+			wrong_id = i
+			wrong_score = s
+		}
+	}
+	if wrong_id < 0 {
+		return
+	}
+
+	m := product(p.mu[true_id], fv) - wrong_score
+	v := p.variance(true_id, fv) + p.variance(wrong_id, fv)
+	if v == 0.0 {
+		return
+	}
+
+	alpha, beta := p.step(m, v)
+	if alpha == 0.0 {
+		return
+	}
+	p.update_from_id(true_id, fv, alpha, beta)
+	p.update_from_id(wrong_id, fv, -alpha, beta)
+}
+
+func (p *ConfidenceWeighted) update_from_id(label_id int, fv []FV, alpha float64, beta float64) {
+	for _, x := range fv {
+		k := x.K
+		p.mu[label_id] = ensure_w(p.mu[label_id], k)
+		p.sigma[label_id] = ensure_sigma(p.sigma[label_id], k)
+
+		s := p.sigma[label_id][k]
+		p.mu[label_id][k] += alpha * s * x.V
+		p.sigma[label_id][k] -= beta * s * s * x.V * x.V
+	}
+}
+
+// Freeze returns a Predictor with a copy of the current means.
+func (p *ConfidenceWeighted) Freeze() *Predictor {
+	return new_predictor(p.Labels.clone(), p.Features.clone(), copy_matrix(p.mu))
+}
+
+// Save writes the means only, so the model can be loaded by
+// NewPredictor.
+func (p *ConfidenceWeighted) Save(w io.Writer) error {
+	return save_weights(w, p.Labels, p.Features, p.mu)
+}
+
+// cw_state is the training state of ConfidenceWeighted in a checkpoint,
+// which has the covariance as well as the means.
+type cw_state struct {
+	Labels   *WordManager
+	Features *WordManager
+	Mu       [][]float64
+	Sigma    [][]float64
+	Variant  CWType
+	R        float64
+	C        float64
+	Phi      float64
+	T        int64
+	BiasID   int64
+}
+
+func (p *ConfidenceWeighted) GobEncode() ([]byte, error) {
+	return gob_encode(cw_state{
+		p.Labels, p.Features, p.mu, p.sigma,
+		p.variant, p.r, p.c, p.phi, p.t, p.bias_id,
+	})
+}
+
+func (p *ConfidenceWeighted) GobDecode(data []byte) error {
+	var s cw_state
+	if err := gob_decode(data, &s); err != nil {
+		return err
+	}
+	p.Labels, p.Features, p.mu, p.sigma = s.Labels, s.Features, s.Mu, s.Sigma
+	p.variant, p.r, p.c, p.phi, p.t, p.bias_id = s.Variant, s.R, s.C, s.Phi, s.T, s.BiasID
+	return nil
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2014 TOKUNAGA Hiroyuki
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package rakai
+
+import (
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+)
+
+// Example is a labeled feature vector.
+type Example struct {
+	Label    string
+	Features []FVS
+}
+
+// Dataset holds examples in memory, so that they are parsed only once
+// and can be trained on for many epochs in any order.
+type Dataset struct {
+	Examples []Example
+	Skipped  int // number of broken lines skipped while reading
+	strings  map[string]string
+}
+
+func NewDataset() *Dataset {
+	var d Dataset
+	d.Examples = make([]Example, 0)
+	d.strings = make(map[string]string)
+	return &d
+}
+
+// intern returns a shared copy of s, so that a label or a feature is
+// stored once however many examples have it, and examples do not keep
+// their whole input lines alive.
+func (d *Dataset) intern(s string) string {
+	if x, ok := d.strings[s]; ok {
+		return x
+	}
+	s = string([]byte(s))
+	d.strings[s] = s
+	return s
+}
+
+// Read appends all examples of er to d.
+func (d *Dataset) Read(er *ExampleReader) error {
+	defer func() { d.Skipped += er.Skipped }()
+	for {
+		label, fvs, err := er.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for i, _ := range fvs {
+			fvs[i].K = d.intern(fvs[i].K)
+		}
+		d.Examples = append(d.Examples, Example{d.intern(label), fvs})
+	}
+}
+
+// ReadFile appends all examples of filename to d.
+func (d *Dataset) ReadFile(filename string, mode ParseMode) error {
+	fi, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+
+	return d.Read(NewExampleReader(fi, filename, mode))
+}
+
+func (d *Dataset) Len() int {
+	return len(d.Examples)
+}
+
+// Shuffle randomly permutes the examples of d. Give r a fixed seed for
+// reproducible training.
+func (d *Dataset) Shuffle(r *rand.Rand) {
+	r.Shuffle(len(d.Examples), func(i, j int) {
+		d.Examples[i], d.Examples[j] = d.Examples[j], d.Examples[i]
+	})
+}
+
+// FeatureCounts returns how many times each feature appears in the
+// examples.
+func (d *Dataset) FeatureCounts() map[string]int {
+	counts := make(map[string]int)
+	for _, x := range d.Examples {
+		for _, fv := range x.Features {
+			counts[fv.K]++
+		}
+	}
+	return counts
+}
+
+// Prune removes rare features from all examples, that is, features
+// which appear less than min_count times, and features beyond the
+// max_features most frequent ones if max_features > 0. Call it before
+// training, so that the removed features are not in the model. It
+// returns the numbers of kept and removed features.
+func (d *Dataset) Prune(min_count int, max_features int) (int, int) {
+	counts := d.FeatureCounts()
+
+	kept := make([]string, 0, len(counts))
+	for k, c := range counts {
+		if c >= min_count {
+			kept = append(kept, k)
+		}
+	}
+	if max_features > 0 && len(kept) > max_features {
+		// ties are broken by features, for reproducibility
+		sort.Slice(kept, func(i, j int) bool {
+			ci, cj := counts[kept[i]], counts[kept[j]]
+			if ci != cj {
+				return ci > cj
+			}
+			return kept[i] < kept[j]
+		})
+		kept = kept[:max_features]
+	}
+	if len(kept) == len(counts) {
+		return len(kept), 0
+	}
+
+	keep := make(map[string]bool, len(kept))
+	for _, k := range kept {
+		keep[k] = true
+	}
+	for i, x := range d.Examples {
+		fvs := x.Features[:0]
+		for _, fv := range x.Features {
+			if keep[fv.K] {
+				fvs = append(fvs, fv)
+			}
+		}
+		d.Examples[i].Features = fvs
+	}
+	return len(kept), len(counts) - len(kept)
+}
+
+// TrainDataset trains cl with one epoch over d, in the current order of
+// d, with threads goroutines. See TrainParallel for threads > 1.
+func TrainDataset(cl Classifier, d *Dataset, threads int) error {
+	if threads <= 1 {
+		for _, x := range d.Examples {
+			cl.Train(x.Label, x.Features)
+		}
+		return nil
+	}
+
+	i := 0
+	next := func() (string, []FVS, error) {
+		if i >= len(d.Examples) {
+			return "", nil, io.EOF
+		}
+		x := d.Examples[i]
+		i++
+		return x.Label, x.Features, nil
+	}
+	return train_parallel(cl, next, threads)
+}
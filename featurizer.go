@@ -0,0 +1,312 @@
+// Copyright (c) 2014 TOKUNAGA Hiroyuki
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Featurizers turn raw text into features, so that documents can be
+// given as "label\tdocument" lines instead of libsvm format. Settings of
+// a featurizer are stored in the model header, and test, predict and
+// serve featurize documents in the same way.
+
+package rakai
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/text/unicode/norm"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Featurizer turns a document into features. It should be safe for
+// concurrent use.
+type Featurizer interface {
+	// Featurize returns the features of doc.
+	Featurize(doc string) []FVS
+	// Header returns the settings, which are stored in the model header.
+	Header() map[string]string
+}
+
+// NewFeaturizer returns the featurizer described by a model header, or
+// nil if the model is trained with libsvm format input.
+func NewFeaturizer(header map[string]string) (Featurizer, error) {
+	switch header["featurizer"] {
+	case "":
+		return nil, nil
+	case "word":
+		n, err := strconv.Atoi(header["ngram"])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid ngram in model header: %q", header["ngram"])
+		}
+		return NewWordNgram(n), nil
+	case "char":
+		min_n, err1 := strconv.Atoi(header["min_n"])
+		max_n, err2 := strconv.Atoi(header["max_n"])
+		if err1 != nil || err2 != nil || min_n < 1 || min_n > max_n {
+			return nil, fmt.Errorf("invalid min_n and max_n in model header: %q, %q", header["min_n"], header["max_n"])
+		}
+		script_break, err := strconv.ParseBool(header["script_break"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid script_break in model header: %q", header["script_break"])
+		}
+		return NewCharNgram(min_n, max_n, script_break), nil
+	}
+	return nil, fmt.Errorf("unknown featurizer in model header: %q", header["featurizer"])
+}
+
+// SetFeaturizer records the settings of f in the model header of cl.
+// Call it before training.
+func SetFeaturizer(cl Classifier, f Featurizer) error {
+	v, ok := cl.(vocabulary)
+	if !ok {
+		return errors.New("featurizer is not supported by this classifier")
+	}
+	_, features := v.words()
+	for key, value := range f.Header() {
+		features.set_info(key, value)
+	}
+	return nil
+}
+
+// FeaturizerOf returns the featurizer recorded in cl, or nil.
+func FeaturizerOf(cl Classifier) (Featurizer, error) {
+	v, ok := cl.(vocabulary)
+	if !ok {
+		return nil, nil
+	}
+	_, features := v.words()
+	return NewFeaturizer(features.header())
+}
+
+// Featurizer returns the featurizer recorded in the model, or nil.
+func (p *Predictor) Featurizer() (Featurizer, error) {
+	return NewFeaturizer(p.Features.header())
+}
+
+// vocabulary is implemented by all classifiers of this package.
+type vocabulary interface {
+	// words returns labels and features
+	words() (*WordManager, *WordManager)
+}
+
+// WordNgram makes word n-grams from 1 to N, whose values are counts.
+// Documents are normalized (see normalize) and split into words at
+// spaces, and each punctuation or symbol is a word by itself. Words of
+// an n-gram are joined by a space.
+type WordNgram struct {
+	N int
+}
+
+func NewWordNgram(n int) *WordNgram {
+	return &WordNgram{n}
+}
+
+func (f *WordNgram) Featurize(doc string) []FVS {
+	words := tokenize(normalize(doc))
+	c := new_counter()
+	for i, _ := range words {
+		for n := 1; n <= f.N && i+n <= len(words); n++ {
+			c.add(strings.Join(words[i:i+n], " "))
+		}
+	}
+	return c.fvs
+}
+
+func (f *WordNgram) Header() map[string]string {
+	return map[string]string{
+		"featurizer": "word",
+		"ngram":      strconv.Itoa(f.N),
+	}
+}
+
+// CharNgram makes character n-grams from MinN to MaxN over code
+// points, whose values are counts. It is for languages without spaces
+// between words, such as Japanese and Chinese. Documents are normalized
+// (see normalize), and n-grams do not cross spaces. With ScriptBreak,
+// n-grams do not cross boundaries of scripts either, e.g. between kanji
+// and hiragana, or letters and digits.
+type CharNgram struct {
+	MinN        int
+	MaxN        int
+	ScriptBreak bool
+}
+
+func NewCharNgram(min_n int, max_n int, script_break bool) *CharNgram {
+	return &CharNgram{min_n, max_n, script_break}
+}
+
+func (f *CharNgram) Featurize(doc string) []FVS {
+	c := new_counter()
+	for _, seg := range f.segments(normalize(doc)) {
+		for i, _ := range seg {
+			for n := f.MinN; n <= f.MaxN && i+n <= len(seg); n++ {
+				c.add(string(seg[i : i+n]))
+			}
+		}
+	}
+	return c.fvs
+}
+
+func (f *CharNgram) Header() map[string]string {
+	return map[string]string{
+		"featurizer":   "char",
+		"min_n":        strconv.Itoa(f.MinN),
+		"max_n":        strconv.Itoa(f.MaxN),
+		"script_break": strconv.FormatBool(f.ScriptBreak),
+	}
+}
+
+// segments splits s at spaces, and at script boundaries if ScriptBreak.
+func (f *CharNgram) segments(s string) [][]rune {
+	segs := make([][]rune, 0)
+	seg := make([]rune, 0)
+	current := script_continue
+	for _, r := range s {
+		script := script_continue
+		if f.ScriptBreak {
+			script = script_of(r)
+		}
+		if unicode.IsSpace(r) || (script != script_continue && current != script_continue && script != current) {
+			if len(seg) > 0 {
+				segs = append(segs, seg)
+				seg = make([]rune, 0)
+			}
+			current = script_continue
+		}
+		if unicode.IsSpace(r) {
+			continue
+		}
+		seg = append(seg, r)
+		if script != script_continue {
+			current = script
+		}
+	}
+	if len(seg) > 0 {
+		segs = append(segs, seg)
+	}
+	return segs
+}
+
+// scripts are the scripts distinguished by script_of. Letters of other
+// scripts are grouped together.
+var scripts = []*unicode.RangeTable{
+	unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul,
+	unicode.Latin, unicode.Cyrillic, unicode.Greek, unicode.Arabic,
+	unicode.Hebrew, unicode.Thai, unicode.Devanagari,
+}
+
+const (
+	script_continue = -(iota + 1)
+	script_digit
+	script_symbol
+	script_other
+)
+
+// script_of returns the index of the script of r in scripts, or one of
+// the script_ constants. Characters shared by scripts, such as marks and
+// the prolonged sound mark "ー", continue the script before them.
+func script_of(r rune) int {
+	switch {
+	case unicode.IsDigit(r):
+		return script_digit
+	case unicode.IsPunct(r) || unicode.IsSymbol(r):
+		return script_symbol
+	case unicode.In(r, unicode.Common, unicode.Inherited):
+		return script_continue
+	}
+	for i, t := range scripts {
+		if unicode.Is(t, r) {
+			return i
+		}
+	}
+	return script_other
+}
+
+// counter counts features in the order of their first appearance, so
+// that the result does not depend on the order of map iteration.
+type counter struct {
+	index map[string]int
+	fvs   []FVS
+}
+
+func new_counter() *counter {
+	var c counter
+	c.index = make(map[string]int)
+	c.fvs = make([]FVS, 0)
+	return &c
+}
+
+func (c *counter) add(k string) {
+	if i, ok := c.index[k]; ok {
+		c.fvs[i].V += 1.0
+		return
+	}
+	c.index[k] = len(c.fvs)
+	c.fvs = append(c.fvs, FVS{k, 1.0})
+}
+
+// normalize applies NFKC normalization to s and lowercases it. NFKC
+// folds fullwidth ASCII and halfwidth katakana, and composes decomposed
+// characters such as "e" + U+0301. Control characters become spaces.
+func normalize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return unicode.ToLower(r)
+	}, norm.NFKC.String(s))
+}
+
+// tokenize splits s into words at spaces. Each punctuation or symbol is
+// a word by itself.
+func tokenize(s string) []string {
+	words := make([]string, 0)
+	begin := -1
+	for i, r := range s {
+		word_char := unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+		if begin >= 0 && !word_char {
+			words = append(words, s[begin:i])
+			begin = -1
+		}
+		if word_char {
+			if begin < 0 {
+				begin = i
+			}
+		} else if !unicode.IsSpace(r) {
+			words = append(words, string(r))
+		}
+	}
+	if begin >= 0 {
+		words = append(words, s[begin:])
+	}
+	return words
+}
+
+// parse_text_line parses a "label\tdocument" line with f. File and Line
+// of the returned error are left for the caller.
+func parse_text_line(s string, f Featurizer) (string, []FVS, *ParseError) {
+	i := strings.IndexByte(s, '\t')
+	if i < 0 {
+		return "", nil, &ParseError{Column: len(s) + 1, Msg: "no tab between label and document"}
+	}
+	if i == 0 {
+		return "", nil, &ParseError{Column: 1, Msg: "empty label"}
+	}
+	return s[:i], f.Featurize(s[i+1:]), nil
+}
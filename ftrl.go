@@ -0,0 +1,218 @@
+// Copyright (c) 2014 TOKUNAGA Hiroyuki
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// FTRL-Proximal with multinomial logistic loss. Each weight keeps z (the
+// sum of adjusted gradients) and n (the sum of squared gradients), and
+// the weight itself is computed from them on demand, with L1 and L2
+// regularization. Weights whose |z| is not larger than l1 are exactly
+// 0, so the model is much sparser than truncated L1.
+// See H. B. McMahan et al., "Ad Click Prediction: a View from the
+// Trenches", KDD 2013.
+
+package rakai
+
+import (
+	"io"
+	"math"
+)
+
+type FTRL struct {
+	Labels   *WordManager
+	Features *WordManager
+	z        [][]float64
+	n        [][]float64
+	alpha    float64
+	beta     float64
+	l1       float64
+	l2       float64
+	t        int64
+	bias_id  int64 // -1 if bias is disabled
+}
+
+func NewFTRL(alpha float64, beta float64, l1 float64, l2 float64) *FTRL {
+	var p FTRL
+
+	p.Labels = NewWordManager()
+	p.Features = NewWordManager()
+	p.z = make([][]float64, 0)
+	p.n = make([][]float64, 0)
+	p.alpha = alpha
+	p.beta = beta
+	p.l1 = l1
+	p.l2 = l2
+	p.t = 0
+	p.bias_id = -1
+	return &p
+}
+
+func (p *FTRL) SetBias(enable bool) {
+	p.bias_id = new_bias_id(p.Features, enable)
+}
+
+func (p *FTRL) words() (*WordManager, *WordManager) {
+	return p.Labels, p.Features
+}
+
+// weight computes the weight of label_id and feature_id from z and n.
+// The bias is not L1 regularized.
+func (p *FTRL) weight(label_id int, feature_id int64) float64 {
+	z := p.z[label_id][feature_id]
+	l1 := p.l1
+	if feature_id == p.bias_id {
+		l1 = 0.0
+	}
+	if math.Abs(z) <= l1 {
+		return 0.0
+	}
+
+	sign := 1.0
+	if z < 0.0 {
+		sign = -1.0
+	}
+	n := p.n[label_id][feature_id]
+	return -(z - sign*l1) / ((p.beta+math.Sqrt(n))/p.alpha + p.l2)
+}
+
+func (p *FTRL) score(label_id int, fv []FV) float64 {
+	score := 0.0
+	for _, x := range fv {
+		if int(x.K) < len(p.z[label_id]) {
+			score += p.weight(label_id, x.K) * x.V
+		}
+	}
+	return score
+}
+
+func (p *FTRL) PredictID(fv []FV) (int, float64, int, float64) {
+	return best_two(len(p.z), func(i int) float64 {
+		return p.score(i, fv)
+	})
+}
+
+func (p *FTRL) Predict(fvs []FVS) Prediction {
+	fv := append_bias(fvs2fv(p.Features, fvs, false), p.bias_id)
+	id, score, second_id, margin := p.PredictID(fv)
+	return make_prediction(p.Labels, id, score, second_id, margin)
+}
+
+// PredictProba returns the probability of each label, the i-th element
+// is the probability of Labels.Word(i).
+func (p *FTRL) PredictProba(fvs []FVS) []float64 {
+	fv := append_bias(fvs2fv(p.Features, fvs, false), p.bias_id)
+	scores := make([]float64, len(p.z))
+	for i, _ := range p.z {
+		scores[i] = p.score(i, fv)
+	}
+	return softmax(scores)
+}
+
+func (p *FTRL) Train(label string, fvs []FVS) {
+	true_id := int(p.Labels.get_word(label, true))
+	fv := append_bias(fvs2fv(p.Features, fvs, true), p.bias_id)
+
+	for len(p.z) < len(p.Labels.id2word) {
+		p.z = append(p.z, make([]float64, 0))
+		p.n = append(p.n, make([]float64, 0))
+	}
+	for label_id, _ := range p.z {
+		for _, x := range fv {
+			p.z[label_id] = ensure_w(p.z[label_id], x.K)
+			p.n[label_id] = ensure_w(p.n[label_id], x.K)
+		}
+	}
+
+	// weights are computed before any update of this example
+	ws := make([][]float64, len(p.z))
+	scores := make([]float64, len(p.z))
+	for label_id, _ := range p.z {
+		ws[label_id] = make([]float64, len(fv))
+		for i, x := range fv {
+			ws[label_id][i] = p.weight(label_id, x.K)
+			scores[label_id] += ws[label_id][i] * x.V
+		}
+	}
+
+	for label_id, prob := range softmax(scores) {
+		g := prob
+		if label_id == true_id {
+			g -= 1.0
+		}
+		for i, x := range fv {
+			grad := g * x.V
+			n := p.n[label_id][x.K]
+			sigma := (math.Sqrt(n+grad*grad) - math.Sqrt(n)) / p.alpha
+			p.z[label_id][x.K] += grad - sigma*ws[label_id][i]
+			p.n[label_id][x.K] += grad * grad
+		}
+	}
+	p.t++
+}
+
+func (p *FTRL) weights() [][]float64 {
+	w := make([][]float64, len(p.z))
+	for label_id, _ := range p.z {
+		w[label_id] = make([]float64, len(p.z[label_id]))
+		for feature_id, _ := range p.z[label_id] {
+			w[label_id][feature_id] = p.weight(label_id, int64(feature_id))
+		}
+	}
+	return w
+}
+
+// Freeze returns a Predictor with a copy of the current weights.
+func (p *FTRL) Freeze() *Predictor {
+	return new_predictor(p.Labels.clone(), p.Features.clone(), p.weights())
+}
+
+func (p *FTRL) Save(w io.Writer) error {
+	return save_weights(w, p.Labels, p.Features, p.weights())
+}
+
+// ftrl_state is the training state of FTRL in a checkpoint. Weights are
+// not stored, since they are computed from z and n.
+type ftrl_state struct {
+	Labels   *WordManager
+	Features *WordManager
+	Z        [][]float64
+	N        [][]float64
+	Alpha    float64
+	Beta     float64
+	L1       float64
+	L2       float64
+	T        int64
+	BiasID   int64
+}
+
+func (p *FTRL) GobEncode() ([]byte, error) {
+	return gob_encode(ftrl_state{
+		p.Labels, p.Features, p.z, p.n,
+		p.alpha, p.beta, p.l1, p.l2, p.t, p.bias_id,
+	})
+}
+
+func (p *FTRL) GobDecode(data []byte) error {
+	var s ftrl_state
+	if err := gob_decode(data, &s); err != nil {
+		return err
+	}
+	p.Labels, p.Features, p.z, p.n = s.Labels, s.Features, s.Z, s.N
+	p.alpha, p.beta, p.l1, p.l2, p.t, p.bias_id = s.Alpha, s.Beta, s.L1, s.L2, s.T, s.BiasID
+	return nil
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2014 TOKUNAGA Hiroyuki
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Feature hashing. A hashed WordManager maps each feature into one of
+// 2^bits buckets by MurmurHash3 with a seed, without storing feature
+// strings, so memory does not grow with new features. Another bit of
+// the hash gives the feature a sign, so that collisions cancel out in
+// expectation. The bias has its own id after the buckets.
+// See K. Weinberger, A. Dasgupta, J. Langford, A. Smola and
+// J. Attenberg, "Feature Hashing for Large Scale Multitask Learning",
+// ICML 2009.
+
+package rakai
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"strconv"
+)
+
+const max_hash_bits = 30
+
+// NewHashedWordManager returns a WordManager which hashes words into
+// 2^hash_bits ids with seed.
+func NewHashedWordManager(hash_bits int, seed uint32) *WordManager {
+	wm := NewWordManager()
+	wm.hash_bits = hash_bits
+	wm.hash_seed = seed
+	return wm
+}
+
+// SetFeatureHashing makes cl hash features into 2^hash_bits buckets
+// with seed. Call it before SetBias and training.
+func SetFeatureHashing(cl Classifier, hash_bits int, seed uint32) error {
+	v, ok := cl.(vocabulary)
+	if !ok {
+		return errors.New("feature hashing is not supported by this classifier")
+	}
+	if hash_bits < 1 || hash_bits > max_hash_bits {
+		return fmt.Errorf("hash bits should be 1 to %d", max_hash_bits)
+	}
+	_, features := v.words()
+	if features.Size() > 0 {
+		return errors.New("feature hashing should be set before training")
+	}
+	features.hash_bits = hash_bits
+	features.hash_seed = seed
+	return nil
+}
+
+// hashed reports whether wm hashes words.
+func (wm *WordManager) hashed() bool {
+	return wm.hash_bits > 0
+}
+
+// bias_bucket is the id of BiasFeature in a hashed WordManager.
+func (wm *WordManager) bias_bucket() int64 {
+	return int64(1) << uint(wm.hash_bits)
+}
+
+// hash returns the id and the sign of word.
+func (wm *WordManager) hash(word string) (int64, float64) {
+	if word == BiasFeature {
+		return wm.bias_bucket(), 1.0
+	}
+	h := murmur3(word, wm.hash_seed)
+	sign := 1.0
+	if h>>31 == 1 {
+		sign = -1.0
+	}
+	return int64(h) & (wm.bias_bucket() - 1), sign
+}
+
+// load_word returns the id of word read from a model file. Features of
+// a hashed model are written as their ids.
+func (wm *WordManager) load_word(word string) (int64, error) {
+	if !wm.hashed() || word == BiasFeature {
+		return wm.get_word(word, true), nil
+	}
+	id, err := strconv.ParseInt(word, 10, 64)
+	if err != nil || id < 0 || id >= wm.bias_bucket() {
+		return -1, fmt.Errorf("invalid hashed feature %q", word)
+	}
+	return id, nil
+}
+
+// set_hash_header makes empty wm hashed as header says.
+func (wm *WordManager) set_hash_header(header map[string]string) error {
+	s := header["hash_bits"]
+	hash_bits, err := strconv.Atoi(s)
+	if err != nil || hash_bits < 1 || hash_bits > max_hash_bits {
+		return fmt.Errorf("invalid hash_bits in model header: %q", s)
+	}
+	seed, err := strconv.ParseUint(header["hash_seed"], 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid hash_seed in model header: %q", header["hash_seed"])
+	}
+	if wm.Size() > 0 {
+		return errors.New("hashed model has feature names")
+	}
+	wm.table = nil
+	wm.hash_bits = hash_bits
+	wm.hash_seed = uint32(seed)
+	return nil
+}
+
+// murmur3 is the 32-bit MurmurHash3 of s.
+func murmur3(s string, seed uint32) uint32 {
+	const (
+		c1 = 0xcc9e2d51
+		c2 = 0x1b873593
+	)
+	h := seed
+	n := len(s)
+	i := 0
+	for ; i+4 <= n; i += 4 {
+		k := uint32(s[i]) | uint32(s[i+1])<<8 | uint32(s[i+2])<<16 | uint32(s[i+3])<<24
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+		h = bits.RotateLeft32(h, 13)
+		h = h*5 + 0xe6546b64
+	}
+
+	var k uint32
+	switch n - i {
+	case 3:
+		k ^= uint32(s[i+2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(s[i+1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(s[i])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+	}
+
+	h ^= uint32(n)
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
@@ -0,0 +1,256 @@
+// Copyright (c) 2014 TOKUNAGA Hiroyuki
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Multinomial logistic regression, trained by SGD with a learning rate
+// schedule (AdaGrad by default) and the same lazy L1 regularization as
+// NBSVM. Unlike the margin based
+// learners, its scores are log-probabilities up to a constant, so
+// PredictProba returns a proper probability distribution.
+
+package rakai
+
+import (
+	"io"
+	"math"
+)
+
+type LogisticRegression struct {
+	Labels   *WordManager
+	Features *WordManager
+	w        [][]float64
+	lu       [][]float64 // last update
+	schedule LearningRateSchedule
+	lambda   float64
+	t        int64
+	bias_id  int64 // -1 if bias is disabled
+}
+
+func NewLogisticRegression(eta float64, lambda float64, enable_adagrad bool) *LogisticRegression {
+	var p LogisticRegression
+
+	p.Labels = NewWordManager()
+	p.Features = NewWordManager()
+	p.w = make([][]float64, 0)
+	p.lu = make([][]float64, 0)
+	if enable_adagrad {
+		p.schedule = NewAdaGrad(eta)
+	} else {
+		p.schedule = NewInverseScaling(eta, 0.1)
+	}
+	p.lambda = lambda
+	p.t = 0
+	p.bias_id = -1
+	return &p
+}
+
+// SetSchedule replaces the learning rate schedule, which is AdaGrad or
+// InverseScaling by default. Call it before training.
+func (p *LogisticRegression) SetSchedule(s LearningRateSchedule) {
+	p.schedule = s
+}
+
+func (p *LogisticRegression) SetBias(enable bool) {
+	p.bias_id = new_bias_id(p.Features, enable)
+}
+
+func (p *LogisticRegression) words() (*WordManager, *WordManager) {
+	return p.Labels, p.Features
+}
+
+func (p *LogisticRegression) calc_learning_rate(label_id int, feature_id int64) float64 {
+	return p.schedule.Rate(int64(label_id), feature_id, p.t)
+}
+
+// weight returns w[label_id][feature_id] with the pending L1
+// regularization applied, without modifying the model. The bias is not
+// regularized.
+func (p *LogisticRegression) weight(label_id int, feature_id int64) float64 {
+	if feature_id == p.bias_id {
+		return p.w[label_id][feature_id]
+	}
+	lu := p.lu[label_id][feature_id]
+	lr := p.calc_learning_rate(label_id, feature_id)
+	return clip(p.w[label_id][feature_id], lu, p.lambda*lr, p.t)
+}
+
+func (p *LogisticRegression) score(label_id int, fv []FV) float64 {
+	score := 0.0
+	for _, x := range fv {
+		if int(x.K) < len(p.w[label_id]) {
+			score += p.weight(label_id, x.K) * x.V
+		}
+	}
+	return score
+}
+
+// PredictID does not modify the model, the pending L1 regularization
+// is applied on the fly.
+func (p *LogisticRegression) PredictID(fv []FV) (int, float64, int, float64) {
+	return best_two(len(p.w), func(i int) float64 {
+		return p.score(i, fv)
+	})
+}
+
+func (p *LogisticRegression) Predict(fvs []FVS) Prediction {
+	fv := append_bias(fvs2fv(p.Features, fvs, false), p.bias_id)
+	id, score, second_id, margin := p.PredictID(fv)
+	return make_prediction(p.Labels, id, score, second_id, margin)
+}
+
+// PredictProbaID returns the probability of each label, the i-th
+// element is the probability of label id i.
+func (p *LogisticRegression) PredictProbaID(fv []FV) []float64 {
+	scores := make([]float64, len(p.w))
+	for i, _ := range p.w {
+		scores[i] = p.score(i, fv)
+	}
+	return softmax(scores)
+}
+
+// PredictProba returns the probability of each label, the i-th element
+// is the probability of Labels.Word(i).
+func (p *LogisticRegression) PredictProba(fvs []FVS) []float64 {
+	fv := append_bias(fvs2fv(p.Features, fvs, false), p.bias_id)
+	return p.PredictProbaID(fv)
+}
+
+// softmax returns exp(scores) normalized to sum up to 1.
+func softmax(scores []float64) []float64 {
+	ret := make([]float64, len(scores))
+	if len(scores) == 0 {
+		return ret
+	}
+
+	max_score := scores[0]
+	for _, s := range scores {
+		if s > max_score {
+			max_score = s
+		}
+	}
+	sum := 0.0
+	for i, s := range scores {
+		ret[i] = math.Exp(s - max_score)
+		sum += ret[i]
+	}
+	for i, _ := range ret {
+		ret[i] /= sum
+	}
+	return ret
+}
+
+func (p *LogisticRegression) regularize_l1(fv []FV) {
+	for label_id, _ := range p.w {
+		for _, x := range fv {
+			if int(x.K) < len(p.w[label_id]) {
+				p.w[label_id][x.K] = p.weight(label_id, x.K)
+				p.lu[label_id][x.K] = float64(p.t)
+			}
+		}
+	}
+}
+
+func (p *LogisticRegression) regularize_l1_all() {
+	for label_id, _ := range p.w {
+		for feature_id, _ := range p.w[label_id] {
+			p.w[label_id][feature_id] = p.weight(label_id, int64(feature_id))
+			p.lu[label_id][feature_id] = float64(p.t)
+		}
+	}
+}
+
+func (p *LogisticRegression) Train(label string, fvs []FVS) {
+	true_id := int(p.Labels.get_word(label, true))
+	fv := append_bias(fvs2fv(p.Features, fvs, true), p.bias_id)
+
+	for len(p.w) < len(p.Labels.id2word) {
+		p.w = append(p.w, make([]float64, 0))
+		p.lu = append(p.lu, make([]float64, 0))
+	}
+	for label_id, _ := range p.w {
+		for _, x := range fv {
+			p.w[label_id] = ensure_w(p.w[label_id], x.K)
+			for len(p.lu[label_id]) < int(x.K)+1 {
+				p.lu[label_id] = append(p.lu[label_id], float64(p.t))
+			}
+		}
+	}
+	p.regularize_l1(fv)
+
+	proba := p.PredictProbaID(fv)
+	for label_id, prob := range proba {
+		// gradient of the negative log-likelihood is (prob - 1) * x for the
+		// true label, and prob * x for the others.
+		g := prob
+		if label_id == true_id {
+			g -= 1.0
+		}
+		for _, x := range fv {
+			p.w[label_id][x.K] += p.schedule.Step(int64(label_id), x.K, -g*x.V, p.t)
+		}
+	}
+	p.t++
+}
+
+// Freeze returns a Predictor with a copy of the current weights.
+func (p *LogisticRegression) Freeze() *Predictor {
+	w := make([][]float64, len(p.w))
+	for label_id, _ := range p.w {
+		w[label_id] = make([]float64, len(p.w[label_id]))
+		for feature_id, _ := range p.w[label_id] {
+			w[label_id][feature_id] = p.weight(label_id, int64(feature_id))
+		}
+	}
+	return new_predictor(p.Labels.clone(), p.Features.clone(), w)
+}
+
+func (p *LogisticRegression) Save(w io.Writer) error {
+	p.regularize_l1_all()
+	return save_weights(w, p.Labels, p.Features, p.w)
+}
+
+// logreg_state is the training state of LogisticRegression in a
+// checkpoint.
+type logreg_state struct {
+	Labels     *WordManager
+	Features   *WordManager
+	W          [][]float64
+	LastUpdate [][]float64
+	Schedule   LearningRateSchedule
+	Lambda     float64
+	T          int64
+	BiasID     int64
+}
+
+func (p *LogisticRegression) GobEncode() ([]byte, error) {
+	return gob_encode(logreg_state{
+		p.Labels, p.Features, p.w, p.lu, p.schedule,
+		p.lambda, p.t, p.bias_id,
+	})
+}
+
+func (p *LogisticRegression) GobDecode(data []byte) error {
+	var s logreg_state
+	if err := gob_decode(data, &s); err != nil {
+		return err
+	}
+	p.Labels, p.Features, p.w, p.lu, p.schedule = s.Labels, s.Features, s.W, s.LastUpdate, s.Schedule
+	p.lambda, p.t, p.bias_id = s.Lambda, s.T, s.BiasID
+	return nil
+}
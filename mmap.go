@@ -0,0 +1,397 @@
+// Copyright (c) 2014 TOKUNAGA Hiroyuki
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Memory-mappable model format. Unlike the binary format, nothing is
+// decoded on loading: the Predictor reads weights and features directly
+// from the mapped file, so a huge model starts instantly, and processes
+// which map the same file share its pages. All integers are little
+// endian.
+//
+//   magic       "RAKAIMAP"
+//   version     uint32
+//   precision   uint32, 4 (float32) or 8 (float64)
+//   labels      uint32, number of labels
+//   features    uint32, number of features
+//   words       uint32, number of words in the feature table, which is
+//               features, or 0 if features are hashed
+//   header      uint32 count, then key and value of each entry, which
+//               are uvarint length and bytes
+//   label table    uint64 offsets (labels + 1), then bytes of labels
+//   feature table  uint64 offsets (words + 1), then bytes of features,
+//                  sorted by bytes for binary search
+//   weights     CSC matrix of labels x features: uint64 column offsets
+//               (features + 1), uint32 label ids and float32 or
+//               float64 values (nonzero weights)
+//
+// Weights are stored column by column, that is, feature by feature, so
+// prediction reads only the columns of the features of an example.
+
+package rakai
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+const (
+	mmap_magic   = "RAKAIMAP"
+	mmap_version = 1
+)
+
+// word_table is a read-only table of words sorted by bytes, whose id is
+// the position in the table.
+type word_table struct {
+	n       int
+	offsets []byte // uint64 * (n + 1)
+	blob    []byte
+}
+
+func (t *word_table) bytes(id int) []byte {
+	begin := binary.LittleEndian.Uint64(t.offsets[id*8:])
+	end := binary.LittleEndian.Uint64(t.offsets[id*8+8:])
+	if begin > end || end > uint64(len(t.blob)) {
+		return nil
+	}
+	return t.blob[begin:end]
+}
+
+// find returns the id of word by binary search, or -1.
+func (t *word_table) find(word string) int64 {
+	i := sort.Search(t.n, func(i int) bool {
+		return string(t.bytes(i)) >= word
+	})
+	if i < t.n && string(t.bytes(i)) == word {
+		return int64(i)
+	}
+	return -1
+}
+
+// mapped_weights is the CSC weight matrix of a mapped model.
+type mapped_weights struct {
+	precision Precision
+	columns   []byte // uint64 * (features + 1)
+	label_ids []byte // uint32 * nnz
+	values    []byte // precision * nnz
+}
+
+func (m *mapped_weights) column(feature_id int64) (uint64, uint64) {
+	begin := binary.LittleEndian.Uint64(m.columns[feature_id*8:])
+	end := binary.LittleEndian.Uint64(m.columns[feature_id*8+8:])
+	if begin > end || end > uint64(len(m.label_ids)/4) {
+		return 0, 0
+	}
+	return begin, end
+}
+
+func (m *mapped_weights) value(i uint64) float64 {
+	if m.precision == Float32 {
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(m.values[i*4:])))
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(m.values[i*8:]))
+}
+
+// scores returns the score of each label for fv.
+func (m *mapped_weights) scores(fv []FV, n_labels int) []float64 {
+	scores := make([]float64, n_labels)
+	for _, x := range fv {
+		begin, end := m.column(x.K)
+		for i := begin; i < end; i++ {
+			label_id := binary.LittleEndian.Uint32(m.label_ids[i*4:])
+			if int(label_id) < n_labels {
+				scores[label_id] += m.value(i) * x.V
+			}
+		}
+	}
+	return scores
+}
+
+// sparse_rows is a CSR matrix of labels x features: nonzero weights of
+// label i are ids[offsets[i]:offsets[i+1]] and values of the same range.
+type sparse_rows struct {
+	offsets []uint64
+	ids     []uint32
+	values  []float64
+}
+
+func (s *sparse_rows) each(fn func(label_id int, feature_id int64, v float64)) {
+	for label_id := 0; label_id+1 < len(s.offsets); label_id++ {
+		for i := s.offsets[label_id]; i < s.offsets[label_id+1]; i++ {
+			fn(label_id, int64(s.ids[i]), s.values[i])
+		}
+	}
+}
+
+// rows transposes the nonzero weights into a CSR matrix, which takes
+// memory for the nonzero weights only.
+func (m *mapped_weights) rows(n_labels int, n_features int) *sparse_rows {
+	s := &sparse_rows{offsets: make([]uint64, n_labels+1)}
+	each_column := func(fn func(label_id uint32, feature_id int, i uint64)) {
+		for feature_id := 0; feature_id < n_features; feature_id++ {
+			begin, end := m.column(int64(feature_id))
+			for i := begin; i < end; i++ {
+				label_id := binary.LittleEndian.Uint32(m.label_ids[i*4:])
+				if int(label_id) < n_labels && m.value(i) != 0.0 {
+					fn(label_id, feature_id, i)
+				}
+			}
+		}
+	}
+
+	each_column(func(label_id uint32, _ int, _ uint64) {
+		s.offsets[label_id+1]++
+	})
+	for i := 1; i < len(s.offsets); i++ {
+		s.offsets[i] += s.offsets[i-1]
+	}
+	nnz := s.offsets[n_labels]
+	s.ids = make([]uint32, nnz)
+	s.values = make([]float64, nnz)
+	next := make([]uint64, n_labels)
+	copy(next, s.offsets)
+	each_column(func(label_id uint32, feature_id int, i uint64) {
+		j := next[label_id]
+		s.ids[j] = uint32(feature_id)
+		s.values[j] = m.value(i)
+		next[label_id]++
+	})
+	return s
+}
+
+// SaveMmap writes the model in the memory-mappable format with weights
+// of precision.
+func (p *Predictor) SaveMmap(w io.Writer, precision Precision) error {
+	if precision != Float32 && precision != Float64 {
+		return fmt.Errorf("unsupported precision: %d", precision)
+	}
+	// new feature ids are the positions in the sorted table, and ids of
+	// hashed features are kept
+	n_features := p.Features.Size()
+	rank := make([]int, n_features)
+	sorted := make([]string, 0, n_features)
+	if p.Features.hashed() {
+		for i, _ := range rank {
+			rank[i] = i
+		}
+	} else {
+		features := make([]string, n_features)
+		order := make([]int, n_features)
+		for i, _ := range order {
+			features[i] = p.Features.Word(int64(i))
+			order[i] = i
+		}
+		sort.Slice(order, func(i, j int) bool {
+			return features[order[i]] < features[order[j]]
+		})
+		for r, id := range order {
+			rank[id] = r
+			sorted = append(sorted, features[id])
+		}
+	}
+
+	// two passes over the nonzero weights, to count and to fill columns
+	columns := make([]uint64, n_features+1)
+	p.each_weight(func(_ int, feature_id int64, _ float64) {
+		columns[rank[feature_id]+1]++
+	})
+	for i := 1; i < len(columns); i++ {
+		columns[i] += columns[i-1]
+	}
+	nnz := columns[n_features]
+	label_ids := make([]uint32, nnz)
+	values := make([]float64, nnz)
+	next := make([]uint64, n_features)
+	copy(next, columns)
+	p.each_weight(func(label_id int, feature_id int64, v float64) {
+		j := next[rank[feature_id]]
+		label_ids[j] = uint32(label_id)
+		values[j] = v
+		next[rank[feature_id]]++
+	})
+
+	labels := make([]string, p.Labels.Size())
+	for i, _ := range labels {
+		labels[i] = p.Labels.Word(int64(i))
+	}
+
+	writer := bufio.NewWriterSize(w, 4096*32)
+	writer.WriteString(mmap_magic)
+	binary.Write(writer, binary.LittleEndian, []uint32{
+		mmap_version, uint32(precision), uint32(len(labels)), uint32(n_features), uint32(len(sorted)),
+	})
+	write_header(writer, p.Features.header())
+	write_table(writer, labels)
+	write_table(writer, sorted)
+	binary.Write(writer, binary.LittleEndian, columns)
+	binary.Write(writer, binary.LittleEndian, label_ids)
+	if precision == Float32 {
+		values32 := make([]float32, len(values))
+		for i, v := range values {
+			values32[i] = float32(v)
+		}
+		binary.Write(writer, binary.LittleEndian, values32)
+	} else {
+		binary.Write(writer, binary.LittleEndian, values)
+	}
+	return writer.Flush()
+}
+
+func write_table(writer *bufio.Writer, words []string) {
+	offsets := make([]uint64, len(words)+1)
+	for i, word := range words {
+		offsets[i+1] = offsets[i] + uint64(len(word))
+	}
+	binary.Write(writer, binary.LittleEndian, offsets)
+	for _, word := range words {
+		writer.WriteString(word)
+	}
+}
+
+// SaveMmapFile saves p into filename in the memory-mappable format.
+func SaveMmapFile(p *Predictor, filename string, precision Precision) error {
+	fi, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	if err := p.SaveMmap(fi, precision); err != nil {
+		fi.Close()
+		return err
+	}
+	return fi.Close()
+}
+
+// is_mmap reports whether the model read by reader is in the
+// memory-mappable format, without consuming it.
+func is_mmap(reader *bufio.Reader) bool {
+	magic, err := reader.Peek(len(mmap_magic))
+	return err == nil && string(magic) == mmap_magic
+}
+
+// section returns the next n bytes, checking n before converting it to
+// int.
+func (d *binary_decoder) section(n uint64) []byte {
+	if n > uint64(len(d.data)) {
+		d.err = errBinaryFormat
+		return nil
+	}
+	return d.next(int(n))
+}
+
+func (d *binary_decoder) table(n uint32) *word_table {
+	t := &word_table{n: int(n)}
+	t.offsets = d.section((uint64(n) + 1) * 8)
+	if d.err != nil {
+		return nil
+	}
+	t.blob = d.section(binary.LittleEndian.Uint64(t.offsets[n*8:]))
+	return t
+}
+
+// parse_mmap returns a Predictor which reads data of the memory-mappable
+// format. data must not be modified while the Predictor is used.
+func parse_mmap(data []byte) (*Predictor, error) {
+	d := &binary_decoder{data: data}
+
+	d.next(len(mmap_magic))
+	version := d.uint32()
+	if d.err == nil && version != mmap_version {
+		return nil, fmt.Errorf("unsupported mmap model version %d", version)
+	}
+	var m mapped_weights
+	m.precision = Precision(d.uint32())
+	if d.err == nil && m.precision != Float32 && m.precision != Float64 {
+		return nil, fmt.Errorf("unsupported precision: %d", m.precision)
+	}
+	n_labels := d.uint32()
+	n_features := d.uint32()
+	n_words := d.uint32()
+	header := d.header()
+
+	label_table := d.table(n_labels)
+	feature_table := d.table(n_words)
+	m.columns = d.section((uint64(n_features) + 1) * 8)
+	if d.err != nil {
+		return nil, d.err
+	}
+	nnz := binary.LittleEndian.Uint64(m.columns[n_features*8:])
+	m.label_ids = d.section(nnz * 4)
+	m.values = d.section(nnz * uint64(m.precision))
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	// labels are few, so they are decoded as usual
+	labels := NewWordManager()
+	for i := 0; i < label_table.n; i++ {
+		labels.add_word(string(label_table.bytes(i)))
+	}
+	features := &WordManager{table: feature_table}
+	if err := features.set_header(header); err != nil {
+		return nil, fmt.Errorf("mmap model format error: %v", err)
+	}
+	if features.Size() != int(n_features) {
+		return nil, errors.New("mmap model format error: wrong number of features")
+	}
+
+	p := new_predictor(labels, features, nil)
+	p.mapped = &m
+	return p, nil
+}
+
+// OpenMmap maps a model of the memory-mappable format. The Predictor
+// reads the mapped file until Close is called. On platforms without
+// mmap, the file is read into memory.
+func OpenMmap(filename string) (*Predictor, error) {
+	fi, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	data, release, err := map_file(fi)
+	if err != nil {
+		return nil, err
+	}
+	p, err := parse_mmap(data)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	p.release = release
+	return p, nil
+}
+
+// Close unmaps the model of a Predictor returned by OpenMmap. The
+// Predictor must not be used after Close. For other Predictors, Close
+// does nothing.
+func (p *Predictor) Close() error {
+	if p.release == nil {
+		return nil
+	}
+	release := p.release
+	p.release = nil
+	return release()
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2014 TOKUNAGA Hiroyuki
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package rakai
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+// TestMmapRoundTrip checks that a model saved with Float64 in the
+// memory-mappable format is restored exactly by OpenMmap, and that a
+// mapped model is converted into the other formats exactly.
+func TestMmapRoundTrip(t *testing.T) {
+	for _, hash_bits := range []int{0, 10} {
+		cl := NewNBSVM(0.01, 0.1, 1.0e-8, true)
+		if hash_bits > 0 {
+			if err := SetFeatureHashing(cl, hash_bits, 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cl.SetBias(true)
+		if err := TrainDataset(cl, synthetic_dataset(500, 4, 1), 1); err != nil {
+			t.Fatal(err)
+		}
+		p := cl.Freeze()
+
+		filename := filepath.Join(t.TempDir(), "model.map")
+		if err := SaveMmapFile(p, filename, Float64); err != nil {
+			t.Fatal(err)
+		}
+		q, err := OpenMmap(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer q.Close()
+
+		if q.Labels.Size() != p.Labels.Size() || q.Features.Size() != p.Features.Size() {
+			t.Fatalf("hash_bits %d: %d labels and %d features, want %d and %d", hash_bits,
+				q.Labels.Size(), q.Features.Size(), p.Labels.Size(), p.Features.Size())
+		}
+		if hash_bits == 0 {
+			for id := 0; id < p.Features.Size(); id++ {
+				word := p.Features.Word(int64(id))
+				if q.Features.Word(q.Features.ID(word)) != word {
+					t.Errorf("feature %q is not found", word)
+				}
+			}
+		}
+		check_weights(t, p, q)
+
+		for i, e := range synthetic_dataset(100, 4, 2).Examples {
+			if got, want := q.Predict(e.Features), p.Predict(e.Features); got != want {
+				t.Errorf("hash_bits %d: prediction %d = %v, want %v", hash_bits, i, got, want)
+			}
+		}
+
+		// a mapped model is written from its mapped weights
+		var buf bytes.Buffer
+		if err := q.SaveBinary(&buf, Float64); err != nil {
+			t.Fatal(err)
+		}
+		r, err := LoadPredictor(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check_weights(t, p, r)
+	}
+}
+
+// TestMmapBroken checks that truncated data is rejected.
+func TestMmapBroken(t *testing.T) {
+	cl := NewNBSVM(0.01, 0.1, 1.0e-8, true)
+	if err := TrainDataset(cl, synthetic_dataset(100, 3, 1), 1); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := cl.Freeze().SaveMmap(&buf, Float32); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	for _, n := range []int{0, 8, 20, len(data) / 2, len(data) - 1} {
+		if _, err := parse_mmap(data[:n]); err == nil {
+			t.Errorf("parse_mmap of %d of %d bytes succeeded", n, len(data))
+		}
+	}
+	if _, err := parse_mmap(data); err != nil {
+		t.Error(err)
+	}
+}
@@ -21,10 +21,8 @@
 package rakai
 
 import (
-	"bufio"
-	"fmt"
+	"io"
 	"math"
-	"os"
 )
 
 type NBSVM struct {
@@ -37,32 +35,45 @@ type NBSVM struct {
 	class_count     []int64
 	class_count_all int64
 	alpha           float64 // smoothness parameter
-	eta             float64
 	t               int64
 	lambda          float64
-	ada             [][]float64
+	schedule        LearningRateSchedule
 	enable_nb       bool
-	enable_adagrad  bool
+	bias_id         int64 // -1 if bias is disabled
+	reg             Regularization
+	l1_ratio        float64 // ratio of L1 in elastic-net
 }
 
+type Regularization int
+
+const (
+	L1 Regularization = iota
+	L2
+	ElasticNet
+)
+
 func NewNBSVM(alpha float64, eta float64, lambda float64, enable_adagrad bool) *NBSVM {
 	var nbsvm NBSVM
 	nbsvm.Labels = NewWordManager()
 	nbsvm.Features = NewWordManager()
-	nbsvm.ada = make([][]float64, 0)
 	nbsvm.w = make([][]float64, 0)
 	nbsvm.lu = make([][]float64, 0)
-	nbsvm.ada = make([][]float64, 0)
 	nbsvm.count = make([][]int64, 0)
 	nbsvm.all_count = make([]int64, 0)
 	nbsvm.class_count = make([]int64, 0)
 	nbsvm.class_count_all = 0
 	nbsvm.alpha = alpha
-	nbsvm.eta = eta
 	nbsvm.t = 0
 	nbsvm.lambda = lambda
+	if enable_adagrad {
+		nbsvm.schedule = &legacy_adagrad{}
+	} else {
+		nbsvm.schedule = NewInverseScaling(eta, 0.1)
+	}
 	nbsvm.enable_nb = true
-	nbsvm.enable_adagrad = enable_adagrad
+	nbsvm.bias_id = -1
+	nbsvm.reg = L1
+	nbsvm.l1_ratio = 1.0
 	return &nbsvm
 }
 
@@ -72,6 +83,32 @@ func NewSVM(eta float64, lambda float64, enable_adagrad bool) *NBSVM {
 	return p
 }
 
+// SetSchedule replaces the learning rate schedule, which is a variant
+// of AdaGrad (see legacy_adagrad) or InverseScaling by default. Call it
+// before training.
+func (nbsvm *NBSVM) SetSchedule(s LearningRateSchedule) {
+	nbsvm.schedule = s
+}
+
+func (nbsvm *NBSVM) SetBias(enable bool) {
+	nbsvm.bias_id = new_bias_id(nbsvm.Features, enable)
+}
+
+// SetRegularization changes the regularization, default is L1. lambda
+// is the strength of L1 or L2, and is split into lambda*l1_ratio for L1
+// and lambda*(1-l1_ratio) for L2 in ElasticNet. Call it before training.
+func (nbsvm *NBSVM) SetRegularization(reg Regularization, l1_ratio float64) {
+	nbsvm.reg = reg
+	switch reg {
+	case L1:
+		nbsvm.l1_ratio = 1.0
+	case L2:
+		nbsvm.l1_ratio = 0.0
+	default:
+		nbsvm.l1_ratio = l1_ratio
+	}
+}
+
 func (nbsvm *NBSVM) update_nb_count(label_id int64, fv []FV) {
 	if !nbsvm.enable_nb {
 		return
@@ -100,7 +137,7 @@ func (nbsvm *NBSVM) update_nb_count(label_id int64, fv []FV) {
 }
 
 func calc_weight(nbsvm *NBSVM, label_id, feature_id int64) float64 {
-	if !nbsvm.enable_nb {
+	if !nbsvm.enable_nb || feature_id == nbsvm.bias_id {
 		return 1.0
 	}
 
@@ -145,36 +182,31 @@ func (nbsvm *NBSVM) reweight(label_id int64, fv []FV) []FV {
 	return new_fv
 }
 
-func (p *NBSVM) predict_id(fv []FV) (int, float64, int, float64) {
-	p.regularize_l1(fv)
-
-	id := 0
-	second_id := 0
-	// TODO: fix -10000.0
-	max_score := -100000.0
-	second_score := -100000.0
-	for i, w := range p.w {
-		score := product(w, fv)
-		if score > max_score {
-			second_id = id
-			second_score = max_score
-			max_score = score
-			id = i
-		} else if score > second_score {
-			second_id = id
-			second_score = score
+// PredictID does not modify the model, the pending regularization
+// is applied on the fly. It is still unsafe to call PredictID
+// concurrently with Train, use Freeze for that.
+func (p *NBSVM) PredictID(fv []FV) (int, float64, int, float64) {
+	return best_two(len(p.w), func(i int) float64 {
+		score := 0.0
+		for _, x := range fv {
+			if int(x.K) < len(p.w[i]) {
+				score += p.weight(i, x.K) * x.V
+			}
 		}
-	}
-	return id, max_score, second_id, max_score - second_score
+		return score
+	})
 }
 
-func (p *NBSVM) predict(fvs []FVS) (string, float64) {
-	fv := fvs2fv(p.Features, fvs, false)
-	id, score, _, _ := p.predict_id(fv)
-	return p.Labels.id2word[id], score
+func (p *NBSVM) Predict(fvs []FVS) Prediction {
+	fv := append_bias(fvs2fv(p.Features, fvs, false), p.bias_id)
+	id, score, second_id, margin := p.PredictID(fv)
+	return make_prediction(p.Labels, id, score, second_id, margin)
 }
 
-func (p *NBSVM) clip(v float64, lu float64, lambda float64, t int64) float64 {
+// clip applies L1 regularization lazily: v is moved toward 0 by lambda
+// for each step from lu (the time of the last update) to t, and is
+// truncated at 0.
+func clip(v float64, lu float64, lambda float64, t int64) float64 {
 	c := (float64(t) - lu) * lambda
 	if v > 0.0 {
 		if v > c {
@@ -183,7 +215,7 @@ func (p *NBSVM) clip(v float64, lu float64, lambda float64, t int64) float64 {
 		return 0.0
 	}
 	if v < 0.0 {
-		if v < c {
+		if v < -c {
 			return v + c
 		}
 		return 0.0
@@ -191,14 +223,40 @@ func (p *NBSVM) clip(v float64, lu float64, lambda float64, t int64) float64 {
 	return 0.0
 }
 
-func (p *NBSVM) regularize_l1(fv []FV) {
+// decay applies L2 regularization (weight decay) lazily: v is scaled by
+// (1 - lambda) for each step from lu to t.
+func decay(v float64, lu float64, lambda float64, t int64) float64 {
+	if lambda >= 1.0 {
+		return 0.0
+	}
+	return v * math.Pow(1.0-lambda, float64(t)-lu)
+}
+
+// weight returns w[label_id][feature_id] with the pending
+// regularization applied, without modifying the model. The bias is not
+// regularized.
+func (p *NBSVM) weight(label_id int, feature_id int64) float64 {
+	v := p.w[label_id][feature_id]
+	if feature_id == p.bias_id {
+		return v
+	}
+	lu := p.lu[label_id][feature_id]
+	lr := p.calc_learning_rate(int64(label_id), feature_id)
+	if p.l1_ratio < 1.0 {
+		v = decay(v, lu, p.lambda*(1.0-p.l1_ratio)*lr, p.t)
+	}
+	if p.l1_ratio > 0.0 {
+		v = clip(v, lu, p.lambda*p.l1_ratio*lr, p.t)
+	}
+	return v
+}
+
+func (p *NBSVM) regularize(fv []FV) {
 	for label_id, _ := range p.w {
 		for _, x := range fv {
 			feature_id := x.K
 			if int(feature_id) < len(p.w[label_id]) {
-				lu := p.lu[label_id][feature_id]
-				lr := p.calc_learning_rate(int64(label_id), int64(feature_id))
-				p.w[label_id][feature_id] = p.clip(p.w[label_id][feature_id], lu, p.lambda*lr, p.t)
+				p.w[label_id][feature_id] = p.weight(label_id, feature_id)
 			} else {
 				for len(p.lu[label_id]) < int(x.K)+1 {
 					p.lu[label_id] = append(p.lu[label_id], float64(p.t))
@@ -209,27 +267,34 @@ func (p *NBSVM) regularize_l1(fv []FV) {
 	}
 }
 
-func (p *NBSVM) regularize_l1_all() {
+func (p *NBSVM) regularize_all() {
 	for label_id, _ := range p.w {
-		for feature_id, v := range p.w[label_id] {
-			lu := p.lu[label_id][feature_id]
-			lr := p.calc_learning_rate(int64(label_id), int64(feature_id))
-			p.w[label_id][feature_id] = p.clip(v, lu, p.lambda*lr, p.t)
+		for feature_id, _ := range p.w[label_id] {
+			p.w[label_id][feature_id] = p.weight(label_id, int64(feature_id))
 			p.lu[label_id][feature_id] = float64(p.t)
 		}
 	}
 }
 
-func (p *NBSVM) train1(label string, fvs []FVS) {
-	true_id, ok := p.Labels.word2id[label]
-
-	if !ok {
-		p.Labels.add_word(label)
+// Freeze returns a Predictor with a copy of the current weights.
+func (p *NBSVM) Freeze() *Predictor {
+	w := make([][]float64, len(p.w))
+	for label_id, _ := range p.w {
+		w[label_id] = make([]float64, len(p.w[label_id]))
+		for feature_id, _ := range p.w[label_id] {
+			w[label_id][feature_id] = p.weight(label_id, int64(feature_id))
+		}
 	}
-	fv := fvs2fv(p.Features, fvs, true)
+	return new_predictor(p.Labels.clone(), p.Features.clone(), w)
+}
+
+func (p *NBSVM) Train(label string, fvs []FVS) {
+	true_id := p.Labels.get_word(label, true)
+	fv := append_bias(fvs2fv(p.Features, fvs, true), p.bias_id)
 	p.update_nb_count(true_id, fv)
+	p.regularize(fv)
 
-	predicted_id, _, second_id, margin := p.predict_id(fv)
+	predicted_id, _, second_id, margin := p.PredictID(fv)
 
 	rw_fv := p.reweight(true_id, fv)
 
@@ -251,60 +316,123 @@ func ensure_lu(lu []float64, k int64) []float64 {
 }
 
 func (p *NBSVM) calc_learning_rate(label_id, feature_id int64) float64 {
-	if p.enable_adagrad {
-		return 1.0 / math.Sqrt(p.ada[label_id][feature_id]+1.0)
-	} else {
-		return math.Pow(p.eta/(1.0+p.eta*float64(p.t)), 0.1)
-	}
+	return p.schedule.Rate(label_id, feature_id, p.t)
 }
 
 func (p *NBSVM) update_from_id(label_id int64, fv []FV, coeff float64) {
 	for len(p.w) < int(label_id)+1 {
 		p.w = append(p.w, make([]float64, 0))
 		p.lu = append(p.lu, make([]float64, 0.0))
-		p.ada = append(p.ada, make([]float64, 0.0))
 	}
 	for i := 0; i < len(fv); i++ {
 		k := fv[i].K
 
 		p.w[label_id] = ensure_w(p.w[label_id], k)
 		p.lu[label_id] = ensure_lu(p.lu[label_id], k)
-		p.ada[label_id] = ensure_lu(p.ada[label_id], k)
-
-		lr := p.calc_learning_rate(label_id, k)
-		delta := fv[i].V * coeff * lr
 
-		p.w[label_id][k] += delta
-		p.ada[label_id][k] += delta * delta
+		p.w[label_id][k] += p.schedule.Step(label_id, k, fv[i].V*coeff, p.t)
 	}
 }
 
-func (p *NBSVM) Save(filename string) {
-	p.regularize_l1_all()
-	fi, err := os.Create(filename)
+func (p *NBSVM) words() (*WordManager, *WordManager) {
+	return p.Labels, p.Features
+}
 
-	defer func() {
-		if err := fi.Close(); err != nil {
-			panic(err)
-		}
-	}()
+// clone applies the pending regularization before copying, so that the
+// workers start from the same time.
+func (p *NBSVM) clone() mixable {
+	p.regularize_all()
+
+	c := *p
+	c.w = copy_matrix(p.w)
+	c.lu = copy_matrix(p.lu)
+	c.schedule = p.schedule.Clone()
+	c.count = copy_matrix_int(p.count)
+	c.all_count = append([]int64{}, p.all_count...)
+	c.class_count = append([]int64{}, p.class_count...)
+	return &c
+}
 
-	if err != nil {
-		panic(err)
+func (p *NBSVM) mix(workers []mixable) {
+	ws := make([][][]float64, len(workers))
+	schedules := make([]LearningRateSchedule, len(workers))
+	counts := make([][][]int64, len(workers))
+	all_counts := make([][][]int64, len(workers))
+	class_counts := make([][][]int64, len(workers))
+	t := p.t
+	class_count_all := p.class_count_all
+
+	for i, x := range workers {
+		q := x.(*NBSVM)
+		q.regularize_all()
+		ws[i] = q.w
+		schedules[i] = q.schedule
+		counts[i] = q.count
+		all_counts[i] = [][]int64{q.all_count}
+		class_counts[i] = [][]int64{q.class_count}
+		t += q.t - p.t
+		class_count_all += q.class_count_all - p.class_count_all
 	}
 
-	writer := bufio.NewWriterSize(fi, 4096*32)
-
-	for label_id, values := range p.w {
-		label := p.Labels.id2word[label_id]
-		for feature_id, v := range values {
-			if v != 0.0 {
-				feature := p.Features.id2word[feature_id]
-				//				fmt.Fprintf(os.Stderr, "%s\t%s\t%2.4f\n", label, feature, v)
-				//				v *= calc_weight(p, int64(label_id), int64(feature_id))
-				writer.WriteString(fmt.Sprintf("%s\t%s\t%2.4f\n", label, feature, v))
-			}
+	p.count = merge_counts(p.count, counts)
+	p.class_count = merge_counts([][]int64{p.class_count}, class_counts)[0]
+	p.all_count = merge_counts([][]int64{p.all_count}, all_counts)[0]
+	p.class_count_all = class_count_all
+
+	p.w = average_matrix(ws)
+	merge_schedules(p.schedule, schedules)
+	p.t = t
+	p.lu = make([][]float64, len(p.w))
+	for i, row := range p.w {
+		p.lu[i] = make([]float64, len(row))
+		for j, _ := range row {
+			p.lu[i][j] = float64(t)
 		}
 	}
-	writer.Flush()
+}
+
+func (p *NBSVM) Save(w io.Writer) error {
+	p.regularize_all()
+	return save_weights(w, p.Labels, p.Features, p.w)
+}
+
+// nbsvm_state is the training state of NBSVM in a checkpoint.
+type nbsvm_state struct {
+	Labels        *WordManager
+	Features      *WordManager
+	W             [][]float64
+	LastUpdate    [][]float64
+	Count         [][]int64
+	AllCount      []int64
+	ClassCount    []int64
+	ClassCountAll int64
+	Alpha         float64
+	T             int64
+	Lambda        float64
+	Schedule      LearningRateSchedule
+	EnableNB      bool
+	BiasID        int64
+	Reg           Regularization
+	L1Ratio       float64
+}
+
+func (nbsvm *NBSVM) GobEncode() ([]byte, error) {
+	return gob_encode(nbsvm_state{
+		nbsvm.Labels, nbsvm.Features, nbsvm.w, nbsvm.lu,
+		nbsvm.count, nbsvm.all_count, nbsvm.class_count, nbsvm.class_count_all,
+		nbsvm.alpha, nbsvm.t, nbsvm.lambda, nbsvm.schedule,
+		nbsvm.enable_nb, nbsvm.bias_id, nbsvm.reg, nbsvm.l1_ratio,
+	})
+}
+
+func (nbsvm *NBSVM) GobDecode(data []byte) error {
+	var s nbsvm_state
+	if err := gob_decode(data, &s); err != nil {
+		return err
+	}
+	nbsvm.Labels, nbsvm.Features, nbsvm.w, nbsvm.lu = s.Labels, s.Features, s.W, s.LastUpdate
+	nbsvm.count, nbsvm.all_count, nbsvm.class_count, nbsvm.class_count_all = s.Count, s.AllCount, s.ClassCount, s.ClassCountAll
+	nbsvm.alpha, nbsvm.t, nbsvm.lambda, nbsvm.schedule = s.Alpha, s.T, s.Lambda, s.Schedule
+	nbsvm.enable_nb, nbsvm.bias_id, nbsvm.reg, nbsvm.l1_ratio = s.EnableNB, s.BiasID, s.Reg, s.L1Ratio
+	return nil
 }
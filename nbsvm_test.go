@@ -0,0 +1,46 @@
+// Copyright (c) 2014 TOKUNAGA Hiroyuki
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package rakai
+
+import (
+	"testing"
+)
+
+// TestClip checks that L1 regularization truncates weights at 0 from
+// both sides.
+func TestClip(t *testing.T) {
+	cases := []struct {
+		v    float64
+		t    int64
+		want float64
+	}{
+		{1.0, 5, 0.5},
+		{1.0, 20, 0.0},
+		{-1.0, 5, -0.5},
+		{-1.0, 20, 0.0},
+		{0.0, 5, 0.0},
+	}
+	for _, c := range cases {
+		if got := clip(c.v, 0.0, 0.1, c.t); got != c.want {
+			t.Errorf("clip(%v, 0, 0.1, %d) = %v, want %v", c.v, c.t, got, c.want)
+		}
+	}
+}
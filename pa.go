@@ -0,0 +1,185 @@
+// Copyright (c) 2014 TOKUNAGA Hiroyuki
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Passive-Aggressive algorithms (PA, PA-I and PA-II) for multiclass
+// classification. The step size is computed from the hinge loss and the
+// norm of the example, instead of a learning rate schedule.
+// See K. Crammer, O. Dekel, J. Keshet, S. Shalev-Shwartz and Y. Singer,
+// "Online Passive-Aggressive Algorithms", JMLR 2006.
+
+package rakai
+
+import (
+	"io"
+	"math"
+)
+
+type PAType int
+
+const (
+	PA  PAType = iota // no upper bound of the step size
+	PA1               // step size is clipped by C
+	PA2               // step size is damped by 1/(2C)
+)
+
+type PassiveAggressive struct {
+	Labels   *WordManager
+	Features *WordManager
+	w        [][]float64
+	c        float64 // aggressiveness parameter
+	variant  PAType
+	t        int64
+	bias_id  int64 // -1 if bias is disabled
+}
+
+func NewPassiveAggressive(variant PAType, c float64) *PassiveAggressive {
+	var p PassiveAggressive
+
+	p.Labels = NewWordManager()
+	p.Features = NewWordManager()
+	p.w = make([][]float64, 0)
+	p.c = c
+	p.variant = variant
+	p.t = 0
+	p.bias_id = -1
+	return &p
+}
+
+func (p *PassiveAggressive) SetBias(enable bool) {
+	p.bias_id = new_bias_id(p.Features, enable)
+}
+
+func (p *PassiveAggressive) words() (*WordManager, *WordManager) {
+	return p.Labels, p.Features
+}
+
+func (p *PassiveAggressive) PredictID(fv []FV) (int, float64, int, float64) {
+	return best_two(len(p.w), func(i int) float64 {
+		return product(p.w[i], fv)
+	})
+}
+
+func (p *PassiveAggressive) Predict(fvs []FVS) Prediction {
+	fv := append_bias(fvs2fv(p.Features, fvs, false), p.bias_id)
+	id, score, second_id, margin := p.PredictID(fv)
+	return make_prediction(p.Labels, id, score, second_id, margin)
+}
+
+func (p *PassiveAggressive) score(label_id int, fv []FV) float64 {
+	if label_id >= len(p.w) {
+		return 0.0
+	}
+	return product(p.w[label_id], fv)
+}
+
+func (p *PassiveAggressive) Train(label string, fvs []FVS) {
+	true_id := p.Labels.get_word(label, true)
+	fv := append_bias(fvs2fv(p.Features, fvs, true), p.bias_id)
+	p.t++
+
+	// the highest scoring wrong label
+	wrong_id := -1
+	wrong_score := math.Inf(-1)
+	for i := 0; i < len(p.Labels.id2word); i++ {
+		if i == int(true_id) {
+			continue
+		}
+		if s := p.score(i, fv); s > wrong_score {
+			wrong_id = i
+			wrong_score = s
+		}
+	}
+	if wrong_id < 0 {
+		return
+	}
+
+	loss := 1.0 - (p.score(int(true_id), fv) - wrong_score)
+	if loss <= 0.0 {
+		return
+	}
+
+	// squared norm of Phi(x, y) - Phi(x, wrong)
+	norm := 0.0
+	for _, x := range fv {
+		norm += 2.0 * x.V * x.V
+	}
+	if norm == 0.0 {
+		return
+	}
+
+	var tau float64
+	switch p.variant {
+	case PA1:
+		tau = math.Min(p.c, loss/norm)
+	case PA2:
+		tau = loss / (norm + 1.0/(2.0*p.c))
+	default:
+		tau = loss / norm
+	}
+
+	p.update_from_id(true_id, fv, tau)
+	p.update_from_id(int64(wrong_id), fv, -tau)
+}
+
+func (p *PassiveAggressive) update_from_id(label_id int64, fv []FV, coeff float64) {
+	for len(p.w) < int(label_id)+1 {
+		p.w = append(p.w, make([]float64, 0))
+	}
+
+	for i := 0; i < len(fv); i++ {
+		k := fv[i].K
+		p.w[label_id] = ensure_w(p.w[label_id], k)
+		p.w[label_id][k] += fv[i].V * coeff
+	}
+}
+
+// Freeze returns a Predictor with a copy of the current weights.
+func (p *PassiveAggressive) Freeze() *Predictor {
+	return new_predictor(p.Labels.clone(), p.Features.clone(), copy_matrix(p.w))
+}
+
+func (p *PassiveAggressive) Save(w io.Writer) error {
+	return save_weights(w, p.Labels, p.Features, p.w)
+}
+
+// pa_state is the training state of PassiveAggressive in a checkpoint.
+type pa_state struct {
+	Labels   *WordManager
+	Features *WordManager
+	W        [][]float64
+	C        float64
+	Variant  PAType
+	T        int64
+	BiasID   int64
+}
+
+func (p *PassiveAggressive) GobEncode() ([]byte, error) {
+	return gob_encode(pa_state{p.Labels, p.Features, p.w, p.c, p.variant, p.t, p.bias_id})
+}
+
+func (p *PassiveAggressive) GobDecode(data []byte) error {
+	var s pa_state
+	if err := gob_decode(data, &s); err != nil {
+		return err
+	}
+	p.Labels, p.Features, p.w = s.Labels, s.Features, s.W
+	p.c, p.variant, p.t, p.bias_id = s.C, s.Variant, s.T, s.BiasID
+	return nil
+}
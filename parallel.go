@@ -0,0 +1,191 @@
+// Copyright (c) 2014 TOKUNAGA Hiroyuki
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Parallel training by iterative parameter mixing.
+//
+// Examples are read in chunks. For each chunk, every worker starts from a
+// copy of the current model, trains on its own shard, and then the
+// workers are mixed into the model (weights are averaged, counts are
+// summed). See R. McDonald, K. Hall and G. Mann, "Distributed Training
+// Strategies for the Structured Perceptron", NAACL 2010.
+
+package rakai
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// number of examples each worker trains between two mixings
+const mixing_interval = 10000
+
+type mixable interface {
+	Classifier
+	vocabulary
+	// clone returns a copy of the model which shares labels and features
+	clone() mixable
+	// mix merges workers, which are cloned from the receiver
+	mix(workers []mixable)
+}
+
+// TrainParallel trains cl with examples of er with threads goroutines.
+// cl should be NBSVM or Perceptron, other classifiers return an error.
+func TrainParallel(cl Classifier, er *ExampleReader, threads int) error {
+	if threads <= 1 {
+		return TrainReader(cl, er)
+	}
+	return train_parallel(cl, er.Next, threads)
+}
+
+// train_parallel trains cl with examples returned by next, until next
+// returns io.EOF.
+func train_parallel(cl Classifier, next func() (string, []FVS, error), threads int) error {
+	m, ok := cl.(mixable)
+	if !ok {
+		return errors.New("parallel training is not supported by this algorithm")
+	}
+	labels, features := m.words()
+
+	for {
+		chunk := make([]example, 0, threads*mixing_interval)
+		for len(chunk) < cap(chunk) {
+			label, fvs, err := next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+
+			// register all words here, so that workers only read them
+			labels.get_word(label, true)
+			for _, x := range fvs {
+				features.get_word(x.K, true)
+			}
+			chunk = append(chunk, example{label: label, fvs: fvs})
+		}
+		if len(chunk) == 0 {
+			return nil
+		}
+
+		workers := make([]mixable, threads)
+		for i, _ := range workers {
+			workers[i] = m.clone()
+		}
+
+		var wg sync.WaitGroup
+		for i, _ := range workers {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := i; j < len(chunk); j += threads {
+					workers[i].Train(chunk[j].label, chunk[j].fvs)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		m.mix(workers)
+
+		if len(chunk) < cap(chunk) {
+			return nil
+		}
+	}
+}
+
+func copy_matrix(m [][]float64) [][]float64 {
+	ret := make([][]float64, len(m))
+	for i, row := range m {
+		ret[i] = make([]float64, len(row))
+		copy(ret[i], row)
+	}
+	return ret
+}
+
+func copy_matrix_int(m [][]int64) [][]int64 {
+	ret := make([][]int64, len(m))
+	for i, row := range m {
+		ret[i] = make([]int64, len(row))
+		copy(ret[i], row)
+	}
+	return ret
+}
+
+// average_matrix returns the element-wise average of ms. Missing
+// elements of shorter rows are treated as 0.
+func average_matrix(ms [][][]float64) [][]float64 {
+	ret := make([][]float64, 0)
+	for _, m := range ms {
+		for len(ret) < len(m) {
+			ret = append(ret, make([]float64, 0))
+		}
+		for i, row := range m {
+			for j, v := range row {
+				ret[i] = ensure_w(ret[i], int64(j))
+				ret[i][j] += v / float64(len(ms))
+			}
+		}
+	}
+	return ret
+}
+
+// merge_matrix returns base + sum of (m - base) for m in ms, that is, the
+// sum of changes made by each m is applied to base.
+func merge_matrix(base [][]float64, ms [][][]float64) [][]float64 {
+	ret := copy_matrix(base)
+	for _, m := range ms {
+		for len(ret) < len(m) {
+			ret = append(ret, make([]float64, 0))
+		}
+		for i, row := range m {
+			for j, v := range row {
+				ret[i] = ensure_w(ret[i], int64(j))
+				if i < len(base) && j < len(base[i]) {
+					v -= base[i][j]
+				}
+				ret[i][j] += v
+			}
+		}
+	}
+	return ret
+}
+
+// merge_counts is merge_matrix for counts.
+func merge_counts(base [][]int64, ms [][][]int64) [][]int64 {
+	ret := copy_matrix_int(base)
+	for _, m := range ms {
+		for len(ret) < len(m) {
+			ret = append(ret, make([]int64, 0))
+		}
+		for i, row := range m {
+			for len(ret[i]) < len(row) {
+				ret[i] = append(ret[i], 0)
+			}
+			for j, v := range row {
+				if i < len(base) && j < len(base[i]) {
+					v -= base[i][j]
+				}
+				ret[i][j] += v
+			}
+		}
+	}
+	return ret
+}
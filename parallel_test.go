@@ -0,0 +1,60 @@
+// Copyright (c) 2014 TOKUNAGA Hiroyuki
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package rakai
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// TestTrainParallel checks that iterative parameter mixing is as
+// accurate as serial training on a separable dataset.
+func TestTrainParallel(t *testing.T) {
+	train := synthetic_dataset(4000, 5, 1)
+	test := synthetic_dataset(1000, 5, 2)
+	classifiers := map[string]func() Classifier{
+		"nbsvm":      func() Classifier { return NewNBSVM(0.01, 0.1, 1.0e-8, true) },
+		"perceptron": func() Classifier { return NewPerceptron(0.1) },
+	}
+
+	for name, new_classifier := range classifiers {
+		acc := make(map[int]float64)
+		for _, threads := range []int{1, 4} {
+			cl := new_classifier()
+			rng := rand.New(rand.NewSource(1))
+			for i := 0; i < 5; i++ {
+				train.Shuffle(rng)
+				if err := TrainDataset(cl, train, threads); err != nil {
+					t.Fatal(err)
+				}
+			}
+			acc[threads] = accuracy(cl.Freeze(), test)
+			if acc[threads] < 0.9 {
+				t.Errorf("%s with %d threads: accuracy = %f, want >= 0.9", name, threads, acc[threads])
+			}
+		}
+		t.Logf("%s: accuracy %f with 1 thread, %f with 4 threads", name, acc[1], acc[4])
+		if math.Abs(acc[1]-acc[4]) > 0.05 {
+			t.Errorf("%s: accuracy with 4 threads = %f, with 1 thread = %f", name, acc[4], acc[1])
+		}
+	}
+}
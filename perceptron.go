@@ -23,18 +23,16 @@
 package rakai
 
 import (
-	"bufio"
-	"fmt"
-	"math"
-	"os"
+	"io"
 )
 
 type Perceptron struct {
 	Labels   *WordManager
 	Features *WordManager
 	w        [][]float64
-	eta      float64
+	schedule LearningRateSchedule
 	t        int64
+	bias_id  int64 // -1 if bias is disabled
 }
 
 func NewPerceptron(eta float64) *Perceptron {
@@ -43,58 +41,44 @@ func NewPerceptron(eta float64) *Perceptron {
 	p.Labels = NewWordManager()
 	p.Features = NewWordManager()
 	p.w = make([][]float64, 0)
-	p.eta = eta
+	p.schedule = NewInverseScaling(eta, 0.1)
 	p.t = 0
+	p.bias_id = -1
 	return &p
 }
 
-func (p *Perceptron) predict_id(fv []FV) (int, float64, int, float64) {
-	id := 0
-	second_id := 0
-	// TODO: fix -10000.0
-	max_score := -10000.0
-	second_score := -10000.0
-	for i, w := range p.w {
-		score := product(w, fv)
-		if score > max_score {
-			second_id = id
-			second_score = max_score
-			max_score = score
-			id = i
-		} else if score > second_score {
-			second_id = id
-			second_score = score
-		}
-	}
-	return id, max_score, second_id, max_score - second_score
+// SetSchedule replaces the learning rate schedule, which is
+// InverseScaling by default. Call it before training.
+func (p *Perceptron) SetSchedule(s LearningRateSchedule) {
+	p.schedule = s
 }
 
-func (p *Perceptron) predict(fvs []FVS) (string, float64) {
-	fv := fvs2fv(p.Features, fvs, false)
-	id, score, _, _ := p.predict_id(fv)
-	return p.Labels.id2word[id], score
+func (p *Perceptron) SetBias(enable bool) {
+	p.bias_id = new_bias_id(p.Features, enable)
 }
 
-func (p *Perceptron) train1(label string, fvs []FVS) {
-	true_id, ok := p.Labels.word2id[label]
+func (p *Perceptron) PredictID(fv []FV) (int, float64, int, float64) {
+	return best_two(len(p.w), func(i int) float64 {
+		return product(p.w[i], fv)
+	})
+}
 
-	if !ok {
-		p.Labels.add_word(label)
-	}
-	fv := fvs2fv(p.Features, fvs, true)
-	predicted_id, _, second_id, margin := p.predict_id(fv)
+func (p *Perceptron) Predict(fvs []FVS) Prediction {
+	fv := append_bias(fvs2fv(p.Features, fvs, false), p.bias_id)
+	id, score, second_id, margin := p.PredictID(fv)
+	return make_prediction(p.Labels, id, score, second_id, margin)
+}
 
-	// lr: learning rate
-	lr := math.Pow(p.eta/(1.0+p.eta*float64(p.t)), 0.1)
-	if p.t%500 == 0 {
-		fmt.Println(predicted_id, true_id, margin, lr)
-	}
+func (p *Perceptron) Train(label string, fvs []FVS) {
+	true_id := p.Labels.get_word(label, true)
+	fv := append_bias(fvs2fv(p.Features, fvs, true), p.bias_id)
+	predicted_id, _, second_id, margin := p.PredictID(fv)
 	if predicted_id != int(true_id) {
-		p.update_from_id(true_id, fv, lr)
-		p.update_from_id(int64(predicted_id), fv, lr*-1.0)
+		p.update_from_id(true_id, fv, 1.0)
+		p.update_from_id(int64(predicted_id), fv, -1.0)
 	} else if margin < 1.0 {
-		p.update_from_id(true_id, fv, lr)
-		p.update_from_id(int64(second_id), fv, lr*-1.0)
+		p.update_from_id(true_id, fv, 1.0)
+		p.update_from_id(int64(second_id), fv, -1.0)
 	}
 	p.t++
 }
@@ -107,34 +91,69 @@ func (p *Perceptron) update_from_id(label_id int64, fv []FV, coeff float64) {
 	for i := 0; i < len(fv); i++ {
 		k := fv[i].K
 		p.w[label_id] = ensure_w(p.w[label_id], k)
-		p.w[label_id][k] += fv[i].V * coeff
+		p.w[label_id][k] += p.schedule.Step(label_id, k, fv[i].V*coeff, p.t)
 	}
 }
 
-func (p *Perceptron) Save(filename string) {
-	fi, err := os.Create(filename)
+// Freeze returns a Predictor with a copy of the current weights.
+func (p *Perceptron) Freeze() *Predictor {
+	w := make([][]float64, len(p.w))
+	for label_id, values := range p.w {
+		w[label_id] = make([]float64, len(values))
+		copy(w[label_id], values)
+	}
+	return new_predictor(p.Labels.clone(), p.Features.clone(), w)
+}
+
+func (p *Perceptron) words() (*WordManager, *WordManager) {
+	return p.Labels, p.Features
+}
 
-	defer func() {
-		if err := fi.Close(); err != nil {
-			panic(err)
-		}
-	}()
+func (p *Perceptron) clone() mixable {
+	c := *p
+	c.w = copy_matrix(p.w)
+	c.schedule = p.schedule.Clone()
+	return &c
+}
 
-	if err != nil {
-		panic(err)
+func (p *Perceptron) mix(workers []mixable) {
+	ws := make([][][]float64, len(workers))
+	schedules := make([]LearningRateSchedule, len(workers))
+	t := p.t
+	for i, x := range workers {
+		q := x.(*Perceptron)
+		ws[i] = q.w
+		schedules[i] = q.schedule
+		t += q.t - p.t
 	}
+	p.w = average_matrix(ws)
+	merge_schedules(p.schedule, schedules)
+	p.t = t
+}
 
-	writer := bufio.NewWriterSize(fi, 4096*32)
+func (p *Perceptron) Save(w io.Writer) error {
+	return save_weights(w, p.Labels, p.Features, p.w)
+}
 
-	for label_id, values := range p.w {
-		label := p.Labels.id2word[label_id]
-		for feature_id, v := range values {
-			if v != 0.0 {
-				feature := p.Features.id2word[feature_id]
-				//				fmt.Fprintf(os.Stderr, "%s\t%s\t%2.4f\n", label, feature, v)
-				writer.WriteString(fmt.Sprintf("%s\t%s\t%2.4f\n", label, feature, v))
-			}
-		}
+// perceptron_state is the training state of Perceptron in a checkpoint.
+type perceptron_state struct {
+	Labels   *WordManager
+	Features *WordManager
+	W        [][]float64
+	Schedule LearningRateSchedule
+	T        int64
+	BiasID   int64
+}
+
+func (p *Perceptron) GobEncode() ([]byte, error) {
+	return gob_encode(perceptron_state{p.Labels, p.Features, p.w, p.schedule, p.t, p.bias_id})
+}
+
+func (p *Perceptron) GobDecode(data []byte) error {
+	var s perceptron_state
+	if err := gob_decode(data, &s); err != nil {
+		return err
 	}
-	writer.Flush()
+	p.Labels, p.Features, p.w, p.schedule, p.t, p.bias_id = s.Labels, s.Features, s.W, s.Schedule, s.T, s.BiasID
+	return nil
 }
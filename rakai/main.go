@@ -21,92 +21,586 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/tkng/rakai"
 	"log"
+	"math/rand"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func train_file(args []string) {
 	var (
 		adagrad        bool
+		bias           bool
+		reg            string
+		schedule       string
 		algorithm      string
 		model_filename string
 		iterations     int
+		strict         bool
+		threads        int
+		seed           int64
+		shuffle        bool
+		stream         bool
+		valid_filename string
+		patience       int
+		metric         string
+		resume         string
+		checkpoint     string
+		format         string
+		hash_bits      int
+		hash_seed      uint
+		min_count      int
+		max_features   int
+		input          string
+		ngram          int
+		char_ngram     string
+		script_break   bool
 	)
 	fmt.Println(args)
 	fs := flag.NewFlagSet("train", flag.ExitOnError)
-	fs.StringVar(&algorithm, "algorithm", "nbsvm", "algorithm for training , nbsvm (default) or perceptron")
-	fs.StringVar(&algorithm, "a", "nbsvm", "algorithm for training , nbsvm (default) or perceptron")
+	fs.StringVar(&algorithm, "algorithm", "nbsvm", "algorithm for training , nbsvm (default), svm, perceptron, averaged-perceptron, pa, pa1, pa2, arow, scw1, scw2, logreg or ftrl")
+	fs.StringVar(&algorithm, "a", "nbsvm", "algorithm for training , nbsvm (default), svm, perceptron, averaged-perceptron, pa, pa1, pa2, arow, scw1, scw2, logreg or ftrl")
 	fs.BoolVar(&adagrad, "adagrad", true, "enable adagrad")
+	fs.BoolVar(&bias, "bias", false, "learn a bias term for each label")
+	fs.IntVar(&hash_bits, "hash-bits", 0, "hash features into 2^N buckets instead of storing them (0: disabled)")
+	fs.UintVar(&hash_seed, "hash-seed", 0, "seed of the feature hash")
+	fs.IntVar(&min_count, "min-count", 1, "drop features which appear less than N times in training data")
+	fs.IntVar(&max_features, "max-features", 0, "keep only N most frequent features (0: all)")
 	fs.StringVar(&model_filename, "model", "", "model filename")
 	fs.StringVar(&model_filename, "m", "", "model filename")
+	fs.StringVar(&format, "format", "tsv", "model format, tsv, binary or mmap")
+	fs.StringVar(&input, "input", "libsvm", "format of training data, libsvm, text or char (label<TAB>document, featurized into word or character n-grams)")
+	fs.IntVar(&ngram, "ngram", 2, "make word n-grams up to N with -input text")
+	fs.StringVar(&char_ngram, "char-ngram", "1-3", "range of character n-grams with -input char, e.g. 1-3 or 2")
+	fs.BoolVar(&script_break, "script-break", false, "do not make character n-grams across scripts (e.g. kanji and hiragana) with -input char")
 
 	alpha := fs.Float64("alpha", 0.01, "additive parameter")
 	eta := fs.Float64("eta", 0.1, "initial learning rate")
+	fs.StringVar(&schedule, "schedule", "", "learning rate schedule of nbsvm, svm, perceptrons and logreg: constant, invscaling, exponential, adagrad, rmsprop or adam (default: adagrad or invscaling by -adagrad)")
+	power := fs.Float64("power", 0.1, "power of invscaling schedule")
+	decay := fs.Float64("decay", 0.9999, "decay of exponential schedule")
+	rho := fs.Float64("rho", 0.9, "decay of moving average of rmsprop schedule")
+	beta1 := fs.Float64("beta1", 0.9, "beta1 of adam schedule")
+	beta2 := fs.Float64("beta2", 0.999, "beta2 of adam schedule")
 	lambda := fs.Float64("lambda", 1.0e-8, "regularization parameter")
+	fs.StringVar(&reg, "reg", "l1", "regularization of nbsvm and svm, l1 (default), l2 or elasticnet")
+	l1_ratio := fs.Float64("l1-ratio", 0.5, "ratio of L1 in elasticnet")
+	c := fs.Float64("C", 1.0, "aggressiveness parameter of pa1, pa2, scw1 and scw2")
+	r := fs.Float64("r", 1.0, "regularization parameter of arow")
+	confidence := fs.Float64("confidence", 0.95, "confidence parameter of scw1 and scw2")
+	ftrl_alpha := fs.Float64("ftrl-alpha", 0.1, "learning rate parameter alpha of ftrl")
+	ftrl_beta := fs.Float64("ftrl-beta", 1.0, "learning rate parameter beta of ftrl")
+	ftrl_l1 := fs.Float64("ftrl-l1", 1.0, "L1 regularization parameter of ftrl")
+	ftrl_l2 := fs.Float64("ftrl-l2", 1.0, "L2 regularization parameter of ftrl")
 	fs.IntVar(&iterations, "iterations", 10, "iteration number")
 	fs.IntVar(&iterations, "i", 10, "iteration number")
+	fs.BoolVar(&strict, "strict", false, "abort on a broken line instead of skipping it")
+	fs.IntVar(&threads, "threads", 1, "number of goroutines to train (nbsvm, svm and perceptron)")
+	fs.Int64Var(&seed, "seed", 1, "random seed for shuffling")
+	fs.BoolVar(&shuffle, "shuffle", true, "shuffle training data every iteration")
+	fs.StringVar(&valid_filename, "valid", "", "validation file, which is scored after every iteration to keep the best model")
+	fs.IntVar(&patience, "patience", 0, "stop after N iterations without improvement on the validation file (0: never stop)")
+	fs.StringVar(&metric, "metric", "accuracy", "metric on the validation file, accuracy or macro-f1")
+	fs.StringVar(&resume, "resume", "", "checkpoint to continue training from, instead of a new model")
+	fs.StringVar(&checkpoint, "checkpoint", "", "checkpoint filename to store the full training state")
+	fs.BoolVar(&stream, "stream", false, "read training files on every iteration instead of loading them into memory (no shuffling)")
 
 	fs.Parse(args)
 
-	// FIXME: model filename check
+	if model_filename == "" {
+		log.Fatal("model filename is not specified")
+	}
+	if metric != "accuracy" && metric != "macro-f1" {
+		log.Fatal("unsupported metric: ", metric)
+	}
+	if patience > 0 && valid_filename == "" {
+		log.Fatal("-patience requires -valid")
+	}
+	if stream && (min_count > 1 || max_features > 0) {
+		log.Fatal("-min-count and -max-features need training data in memory, they can not be used with -stream")
+	}
+	if format != "tsv" && format != "binary" && format != "mmap" {
+		log.Fatal("unsupported format: ", format)
+	}
+	if input != "libsvm" && input != "text" && input != "char" {
+		log.Fatal("unsupported input: ", input)
+	}
+	if ngram < 1 {
+		log.Fatal("-ngram must be positive")
+	}
+	min_n, max_n, err := parse_range(char_ngram)
+	if err != nil {
+		log.Fatal("-char-ngram: ", err)
+	}
 
 	var p rakai.Classifier
-	switch algorithm {
-	case "nbsvm":
-		p = rakai.NewNBSVM(*alpha, *eta, *lambda, adagrad)
-	case "svm":
-		p = rakai.NewSVM(*eta, *lambda, adagrad)
-	case "perceptron":
-		p = rakai.NewPerceptron(*eta)
-	default:
-		log.Fatal("unsupported algorithm: ", algorithm)
+	if resume != "" {
+		// the algorithm and its parameters are restored from the checkpoint
+		var err error
+		p, err = rakai.LoadCheckpointFile(resume)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		switch algorithm {
+		case "nbsvm":
+			p = rakai.NewNBSVM(*alpha, *eta, *lambda, adagrad)
+		case "svm":
+			p = rakai.NewSVM(*eta, *lambda, adagrad)
+		case "perceptron":
+			p = rakai.NewPerceptron(*eta)
+		case "averaged-perceptron":
+			p = rakai.NewAveragedPerceptron(*eta)
+		case "pa":
+			p = rakai.NewPassiveAggressive(rakai.PA, *c)
+		case "pa1":
+			p = rakai.NewPassiveAggressive(rakai.PA1, *c)
+		case "pa2":
+			p = rakai.NewPassiveAggressive(rakai.PA2, *c)
+		case "logreg":
+			p = rakai.NewLogisticRegression(*eta, *lambda, adagrad)
+		case "ftrl":
+			p = rakai.NewFTRL(*ftrl_alpha, *ftrl_beta, *ftrl_l1, *ftrl_l2)
+		case "arow":
+			p = rakai.NewAROW(*r)
+		case "scw1":
+			p = rakai.NewSCW(rakai.SCW1, *c, *confidence)
+		case "scw2":
+			p = rakai.NewSCW(rakai.SCW2, *c, *confidence)
+		default:
+			log.Fatal("unsupported algorithm: ", algorithm)
+			return
+		}
+		if hash_bits > 0 {
+			if err := rakai.SetFeatureHashing(p, hash_bits, uint32(hash_seed)); err != nil {
+				log.Fatal(err)
+			}
+		}
+		var f rakai.Featurizer
+		switch input {
+		case "text":
+			f = rakai.NewWordNgram(ngram)
+		case "char":
+			f = rakai.NewCharNgram(min_n, max_n, script_break)
+		}
+		if f != nil {
+			if err := rakai.SetFeaturizer(p, f); err != nil {
+				log.Fatal(err)
+			}
+		}
+		p.SetBias(bias)
+
+		if schedule != "" {
+			var s rakai.LearningRateSchedule
+			switch schedule {
+			case "constant":
+				s = rakai.NewConstant(*eta)
+			case "invscaling":
+				s = rakai.NewInverseScaling(*eta, *power)
+			case "exponential":
+				s = rakai.NewExponentialDecay(*eta, *decay)
+			case "adagrad":
+				s = rakai.NewAdaGrad(*eta)
+			case "rmsprop":
+				s = rakai.NewRMSProp(*eta, *rho)
+			case "adam":
+				s = rakai.NewAdam(*eta, *beta1, *beta2)
+			default:
+				log.Fatal("unsupported schedule: ", schedule)
+			}
+
+			sp, ok := p.(interface {
+				SetSchedule(rakai.LearningRateSchedule)
+			})
+			if !ok {
+				log.Fatal("-schedule is supported only by nbsvm, svm, perceptron, averaged-perceptron and logreg")
+			}
+			sp.SetSchedule(s)
+		}
+
+		if nb, ok := p.(*rakai.NBSVM); ok {
+			switch reg {
+			case "l1":
+				nb.SetRegularization(rakai.L1, *l1_ratio)
+			case "l2":
+				nb.SetRegularization(rakai.L2, *l1_ratio)
+			case "elasticnet":
+				nb.SetRegularization(rakai.ElasticNet, *l1_ratio)
+			default:
+				log.Fatal("unsupported regularization: ", reg)
+			}
+		} else if reg != "l1" {
+			log.Fatal("-reg is supported only by nbsvm and svm")
+		}
+	}
+
+	// with -resume, the featurizer is restored from the checkpoint
+	f, err := rakai.FeaturizerOf(p)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var ds *rakai.Dataset
+	if !stream {
+		ds = load_dataset(fs.Args(), parse_mode(strict), f)
+		if min_count > 1 || max_features > 0 {
+			kept, removed := ds.Prune(min_count, max_features)
+			fmt.Println("features:", kept, "kept,", removed, "removed")
+		}
+	}
+	var valid *rakai.Dataset
+	if valid_filename != "" {
+		valid = load_dataset([]string{valid_filename}, parse_mode(strict), f)
+	}
+
+	var best *rakai.Predictor
+	best_score := -1.0
+	no_improvement := 0
+	rng := rand.New(rand.NewSource(seed))
+	for i := 0; i < iterations; i++ {
+		if stream {
+			train_stream(p, fs.Args(), i, parse_mode(strict), f, threads)
+		} else {
+			if shuffle {
+				ds.Shuffle(rng)
+			}
+			if err := rakai.TrainDataset(p, ds, threads); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if valid == nil {
+			continue
+		}
+		snapshot := p.Freeze()
+		st := rakai.TestDataset(snapshot, valid, threads)
+		score, _, _ := rakai.CalcAccuracy(st)
+		if metric == "macro-f1" {
+			score = rakai.CalcMacroF1(st)
+		}
+		fmt.Println("iteration:", i+1, metric+":", score)
+		if score > best_score {
+			best = snapshot
+			best_score = score
+			no_improvement = 0
+		} else {
+			no_improvement++
+			if patience > 0 && no_improvement >= patience {
+				fmt.Println("early stopping, best", metric+":", best_score)
+				break
+			}
+		}
+	}
+
+	if checkpoint != "" {
+		// the last state, not the best one, to continue training
+		if err := rakai.SaveCheckpointFile(p, checkpoint); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var m rakai.Saver = p
+	if best != nil {
+		// save the best snapshot on the validation set
+		m = best
+	}
+	if format != "tsv" {
+		snapshot := best
+		if snapshot == nil {
+			snapshot = p.Freeze()
+		}
+		if err := save_predictor(snapshot, model_filename, format, rakai.Float64); err != nil {
+			log.Fatal(err)
+		}
 		return
 	}
+	if err := rakai.SaveFile(m, model_filename); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func convert(args []string) {
+	var (
+		format string
+		single bool
+	)
+
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	fs.StringVar(&format, "to", "binary", "output format, binary, mmap or tsv")
+	fs.BoolVar(&single, "float32", false, "store weights as float32 in the binary and mmap formats")
+
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		log.Fatal("input and output model filenames are required")
+	}
+	p, err := rakai.NewPredictor(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	precision := rakai.Float64
+	if single {
+		precision = rakai.Float32
+	}
+	if err := save_predictor(p, fs.Arg(1), format, precision); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func save_predictor(p *rakai.Predictor, filename string, format string, precision rakai.Precision) error {
+	switch format {
+	case "tsv":
+		return rakai.SaveFile(p, filename)
+	case "binary":
+		return rakai.SaveBinaryFile(p, filename, precision)
+	case "mmap":
+		return rakai.SaveMmapFile(p, filename, precision)
+	}
+	return fmt.Errorf("unsupported format: %s", format)
+}
 
-	for _, train_filename := range fs.Args() {
+// load_dataset reads all training files into memory. "-" is stdin.
+func load_dataset(filenames []string, mode rakai.ParseMode, f rakai.Featurizer) *rakai.Dataset {
+	ds := rakai.NewDataset()
+	for _, train_filename := range filenames {
 		fmt.Println(train_filename)
 
-		for i := 0; i < iterations; i++ {
-			rakai.TrainFile(p, train_filename)
+		err := read_examples(train_filename, mode, f, ds.Read)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if ds.Skipped > 0 {
+		fmt.Println("skipped:", ds.Skipped, "lines")
+	}
+	return ds
+}
+
+// train_stream trains an epoch without loading files into memory. Every
+// epoch reads the files again in the given order, and stdin is read only
+// in the first epoch.
+func train_stream(p rakai.Classifier, filenames []string, epoch int, mode rakai.ParseMode, f rakai.Featurizer, threads int) {
+	for _, train_filename := range filenames {
+		if epoch == 0 {
+			fmt.Println(train_filename)
+		}
+		if train_filename == "-" && epoch > 0 {
+			continue
+		}
+
+		skipped := 0
+		err := read_examples(train_filename, mode, f, func(er *rakai.ExampleReader) error {
+			err := rakai.TrainParallel(p, er, threads)
+			skipped = er.Skipped
+			return err
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		if epoch == 0 && skipped > 0 {
+			fmt.Println("skipped:", skipped, "lines")
 		}
 	}
-	p.Save(model_filename)
 }
 
 func test_file(args []string) {
 	var (
 		model_filename string
+		strict         bool
+		workers        int
 	)
 
 	fs := flag.NewFlagSet("test", flag.ExitOnError)
 	fs.StringVar(&model_filename, "model", "", "model filename")
 	fs.StringVar(&model_filename, "m", "", "model filename")
+	fs.BoolVar(&strict, "strict", false, "abort on a broken line instead of skipping it")
+	fs.IntVar(&workers, "j", 1, "number of goroutines to parse and predict")
 
 	fs.Parse(args)
 
-	p := rakai.NewPredictor(model_filename)
+	p, err := rakai.NewPredictor(model_filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	f, err := p.Featurizer()
+	if err != nil {
+		log.Fatal(err)
+	}
 
+	if fs.NArg() == 0 {
+		log.Fatal("test filename is not specified")
+	}
 	test_filename := fs.Args()[0]
-	st, err := rakai.TestFile(p, test_filename)
+	err = read_examples(test_filename, parse_mode(strict), f, func(er *rakai.ExampleReader) error {
+		st, err := rakai.TestReader(p, er, workers)
+		if err != nil {
+			return err
+		}
+		for _, label := range rakai.Mapkeys(st) {
+			fmt.Println(label)
+			fmt.Println("  ", rakai.CalcPrecision(st[label]))
+			fmt.Println("  ", rakai.CalcRecall(st[label]))
+			fmt.Println("  ", st[label])
+		}
+		acc, nt, nf := rakai.CalcAccuracy(st)
+		fmt.Println("acc:", acc, nt, nf)
+		fmt.Println("skipped:", er.Skipped, "lines")
+		return nil
+	})
 	if err != nil {
-		fmt.Println(err)
-	}
-	for _, label := range rakai.Mapkeys(st) {
-		fmt.Println(label)
-		fmt.Println("  ", rakai.CalcPrecision(st[label]))
-		fmt.Println("  ", rakai.CalcRecall(st[label]))
-		fmt.Println("  ", st[label])
+		log.Fatal(err)
 	}
-	acc, nt, nf := rakai.CalcAccuracy(st)
-	fmt.Println("acc:", acc, nt, nf)
 }
 
 func predict(args []string) {
-	fmt.Println("sorry, predict is not implemented yet")
-	os.Exit(1)
+	var (
+		model_filename string
+		runner_up      bool
+		strict         bool
+		workers        int
+	)
+
+	fs := flag.NewFlagSet("predict", flag.ExitOnError)
+	fs.StringVar(&model_filename, "model", "", "model filename")
+	fs.StringVar(&model_filename, "m", "", "model filename")
+	fs.BoolVar(&runner_up, "runner-up", false, "also output runner-up label and margin")
+	fs.BoolVar(&runner_up, "r", false, "also output runner-up label and margin")
+	fs.BoolVar(&strict, "strict", false, "abort on a broken line instead of writing a line of empty fields for it")
+	fs.IntVar(&workers, "j", 1, "number of goroutines to parse and predict")
+
+	fs.Parse(args)
+
+	p, err := rakai.NewPredictor(model_filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	f, err := p.Featurizer()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	filenames := fs.Args()
+	if len(filenames) == 0 {
+		filenames = []string{"-"}
+	}
+
+	skipped := 0
+	for _, filename := range filenames {
+		n, err := predict_file(p, filename, parse_mode(strict), f, runner_up, workers)
+		if err != nil {
+			log.Fatal(err)
+		}
+		skipped += n
+	}
+	if skipped > 0 {
+		fmt.Fprintln(os.Stderr, "skipped:", skipped, "lines")
+	}
+}
+
+// predict_file predicts filename ("-" means stdin), and returns the
+// number of skipped lines.
+func predict_file(p *rakai.Predictor, filename string, mode rakai.ParseMode, f rakai.Featurizer, runner_up bool, workers int) (int, error) {
+	skipped := 0
+	err := read_examples(filename, mode, f, func(er *rakai.ExampleReader) error {
+		err := rakai.PredictStream(p, er, os.Stdout, runner_up, workers)
+		skipped = er.Skipped
+		return err
+	})
+	return skipped, err
+}
+
+// read_examples calls fn with an ExampleReader of filename ("-" means
+// stdin). Lines are "label<TAB>document" featurized by f, or libsvm
+// format if f is nil.
+func read_examples(filename string, mode rakai.ParseMode, f rakai.Featurizer, fn func(er *rakai.ExampleReader) error) error {
+	in := os.Stdin
+	if filename != "-" {
+		fi, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer fi.Close()
+		in = fi
+	}
+
+	er := rakai.NewExampleReader(in, filename, mode)
+	er.Featurizer = f
+	return fn(er)
+}
+
+// parse_range parses "min-max" or "n" of positive integers.
+func parse_range(s string) (int, int, error) {
+	min_s, max_s := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		min_s, max_s = s[:i], s[i+1:]
+	}
+	min, err1 := strconv.Atoi(min_s)
+	max, err2 := strconv.Atoi(max_s)
+	if err1 != nil || err2 != nil || min < 1 || min > max {
+		return 0, 0, fmt.Errorf("invalid range: %q", s)
+	}
+	return min, max, nil
+}
+
+func parse_mode(strict bool) rakai.ParseMode {
+	if strict {
+		return rakai.Strict
+	}
+	return rakai.Lenient
+}
+
+func serve(args []string) {
+	var (
+		model_filename   string
+		addr             string
+		shutdown_timeout time.Duration
+	)
+
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.StringVar(&model_filename, "model", "", "model filename")
+	fs.StringVar(&model_filename, "m", "", "model filename")
+	fs.StringVar(&addr, "addr", ":8080", "address to listen on")
+	fs.DurationVar(&shutdown_timeout, "shutdown-timeout", 10*time.Second, "time to wait for in-flight requests on shutdown")
+
+	fs.Parse(args)
+
+	p, err := rakai.NewPredictor(model_filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := rakai.NewServer(p)
+	server := &http.Server{Addr: addr, Handler: s}
+
+	done := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+
+		s.SetReady(false)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdown_timeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Println("shutdown:", err)
+		}
+		close(done)
+	}()
+
+	log.Println("listening on", addr)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
 }
 
 var usage = `
@@ -115,7 +609,9 @@ Usage %s <Command> [Options]
 Commands:
   train   train model
   test    test and caluculate precision, recall, accuracy
-  predict predict
+  predict predict labels of libsvm format lines read from files or stdin
+  serve   serve predictions over HTTP
+  convert convert a model between tsv, binary and mmap formats
 `
 
 func main() {
@@ -138,6 +634,10 @@ func main() {
 		test_file(args[1:])
 	case "predict":
 		predict(args[1:])
+	case "serve":
+		serve(args[1:])
+	case "convert":
+		convert(args[1:])
 	default:
 		flag.Usage()
 		os.Exit(1)
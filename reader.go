@@ -0,0 +1,183 @@
+// Copyright (c) 2014 TOKUNAGA Hiroyuki
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package rakai
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type ParseMode int
+
+const (
+	// Lenient skips lines which can not be parsed, and counts them.
+	Lenient ParseMode = iota
+	// Strict aborts at the first line which can not be parsed.
+	Strict
+)
+
+// ParseError is an error at a line of input. Line and Column are
+// 1-origin, and Column counts bytes.
+type ParseError struct {
+	File   string
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *ParseError) Error() string {
+	file := e.File
+	if file == "" {
+		file = "<input>"
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", file, e.Line, e.Column, e.Msg)
+}
+
+// ExampleReader reads examples from libsvm format input, or from
+// "label\tdocument" lines if Featurizer is set.
+type ExampleReader struct {
+	Name       string
+	Mode       ParseMode
+	Skipped    int        // number of lines skipped in lenient mode
+	Featurizer Featurizer // featurizer of documents, or nil for libsvm format
+
+	reader *bufio.Reader
+	line   int
+}
+
+// NewExampleReader returns an ExampleReader which reads from r. name is
+// used in error messages, usually it is a filename.
+func NewExampleReader(r io.Reader, name string, mode ParseMode) *ExampleReader {
+	var er ExampleReader
+	er.Name = name
+	er.Mode = mode
+	er.reader = bufio.NewReaderSize(r, 4096*64)
+	return &er
+}
+
+// Next returns the label and features of the next example. Empty lines
+// are ignored. It returns io.EOF at the end of input, and a *ParseError
+// if a line is broken in strict mode.
+func (er *ExampleReader) Next() (string, []FVS, error) {
+	for {
+		line, n, err := er.next_line()
+		if err != nil {
+			return "", nil, err
+		}
+
+		label, content, perr := er.parse(line)
+		if perr != nil {
+			if err := er.fail(perr, n); err != nil {
+				return "", nil, err
+			}
+			continue
+		}
+		return label, content, nil
+	}
+}
+
+func (er *ExampleReader) parse(line string) (string, []FVS, *ParseError) {
+	if er.Featurizer != nil {
+		return parse_text_line(line, er.Featurizer)
+	}
+	return parse_line(line)
+}
+
+// next_line returns the next non-empty line and its line number.
+func (er *ExampleReader) next_line() (string, int, error) {
+	for {
+		line, err := read_line(er.reader)
+		if err != nil {
+			return "", 0, err
+		}
+		er.line++
+
+		if strings.TrimSpace(line) != "" {
+			return line, er.line, nil
+		}
+	}
+}
+
+// fail fills the position of perr, which occurred at line n. It returns
+// perr in strict mode, and counts it as skipped in lenient mode.
+func (er *ExampleReader) fail(perr *ParseError, n int) error {
+	perr.File = er.Name
+	perr.Line = n
+	if er.Mode == Strict {
+		return perr
+	}
+	er.Skipped++
+	return nil
+}
+
+func (er *ExampleReader) buffered() int {
+	return er.reader.Buffered()
+}
+
+// read_line reads a line without the line terminator. Unlike
+// bufio.Reader.ReadLine, it returns the whole line even if the line is
+// longer than the buffer.
+func read_line(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+	line = strings.TrimRight(line, "\n")
+	line = strings.TrimRight(line, "\r")
+	return line, err
+}
+
+// parse_line parses a libsvm format line. File and Line of the returned
+// error are left for the caller.
+func parse_line(s string) (string, []FVS, *ParseError) {
+	content := make([]FVS, 0)
+	ss := strings.Split(s, " ")
+	label := ss[0]
+	if label == "" {
+		return "", nil, &ParseError{Column: 1, Msg: "empty label"}
+	}
+
+	column := len(ss[0]) + 2
+	for i := 1; i < len(ss); i++ {
+		e := strings.Split(ss[i], ":")
+
+		if len(e) != 2 {
+			if len(e) != 1 {
+				return "", nil, &ParseError{Column: column, Msg: fmt.Sprintf("element %q should be feature:value", ss[i])}
+			}
+		} else {
+			k := e[0]
+			if k == "" {
+				return "", nil, &ParseError{Column: column, Msg: fmt.Sprintf("empty feature in %q", ss[i])}
+			}
+			v, err := strconv.ParseFloat(e[1], 64)
+			if err != nil {
+				return "", nil, &ParseError{Column: column + len(k) + 1, Msg: fmt.Sprintf("invalid value %q", e[1])}
+			}
+			content = append(content, FVS{k, v})
+		}
+		column += len(ss[i]) + 1
+	}
+	return label, content, nil
+}
@@ -0,0 +1,381 @@
+// Copyright (c) 2014 TOKUNAGA Hiroyuki
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Learning rate schedules. A schedule decides how much a weight moves
+// for a gradient, and may keep per-weight state (AdaGrad, RMSProp and
+// Adam). Weights are identified by (label_id, feature_id).
+
+package rakai
+
+import (
+	"math"
+)
+
+type LearningRateSchedule interface {
+	// Rate returns the current learning rate of weight (label_id,
+	// feature_id) at time t. It is used for regularization, and does not
+	// change the state.
+	Rate(label_id int64, feature_id int64, t int64) float64
+	// Step returns the change of weight (label_id, feature_id) for g at
+	// time t, and updates the state. g is the direction to move the
+	// weight, that is, the negative gradient of the loss.
+	Step(label_id int64, feature_id int64, g float64, t int64) float64
+	// Clone returns a copy of the schedule, which has its own state.
+	Clone() LearningRateSchedule
+}
+
+// schedule_merger is implemented by schedules whose state can be merged
+// after parallel training.
+type schedule_merger interface {
+	merge(workers []LearningRateSchedule)
+}
+
+// per-weight state of a schedule
+type weight_state [][]float64
+
+func (s weight_state) get(label_id int64, feature_id int64) float64 {
+	if int(label_id) < len(s) && int(feature_id) < len(s[label_id]) {
+		return s[label_id][feature_id]
+	}
+	return 0.0
+}
+
+func (s *weight_state) at(label_id int64, feature_id int64) *float64 {
+	for len(*s) < int(label_id)+1 {
+		*s = append(*s, make([]float64, 0))
+	}
+	(*s)[label_id] = ensure_w((*s)[label_id], feature_id)
+	return &(*s)[label_id][feature_id]
+}
+
+// Constant is eta for all time.
+type Constant struct {
+	Eta float64
+}
+
+func NewConstant(eta float64) *Constant {
+	return &Constant{eta}
+}
+
+func (s *Constant) Rate(label_id int64, feature_id int64, t int64) float64 {
+	return s.Eta
+}
+
+func (s *Constant) Step(label_id int64, feature_id int64, g float64, t int64) float64 {
+	return s.Eta * g
+}
+
+func (s *Constant) Clone() LearningRateSchedule {
+	c := *s
+	return &c
+}
+
+// InverseScaling is (eta / (1 + eta * t)) ^ power. With power 0.1, it
+// is the schedule of the perceptron and NBSVM without AdaGrad.
+type InverseScaling struct {
+	Eta   float64
+	Power float64
+}
+
+func NewInverseScaling(eta float64, power float64) *InverseScaling {
+	return &InverseScaling{eta, power}
+}
+
+func (s *InverseScaling) Rate(label_id int64, feature_id int64, t int64) float64 {
+	return math.Pow(s.Eta/(1.0+s.Eta*float64(t)), s.Power)
+}
+
+func (s *InverseScaling) Step(label_id int64, feature_id int64, g float64, t int64) float64 {
+	return s.Rate(label_id, feature_id, t) * g
+}
+
+func (s *InverseScaling) Clone() LearningRateSchedule {
+	c := *s
+	return &c
+}
+
+// ExponentialDecay is eta * decay ^ t.
+type ExponentialDecay struct {
+	Eta   float64
+	Decay float64
+}
+
+func NewExponentialDecay(eta float64, decay float64) *ExponentialDecay {
+	return &ExponentialDecay{eta, decay}
+}
+
+func (s *ExponentialDecay) Rate(label_id int64, feature_id int64, t int64) float64 {
+	return s.Eta * math.Pow(s.Decay, float64(t))
+}
+
+func (s *ExponentialDecay) Step(label_id int64, feature_id int64, g float64, t int64) float64 {
+	return s.Rate(label_id, feature_id, t) * g
+}
+
+func (s *ExponentialDecay) Clone() LearningRateSchedule {
+	c := *s
+	return &c
+}
+
+// AdaGrad is eta / sqrt(1 + sum of squared gradients) for each weight.
+type AdaGrad struct {
+	Eta float64
+	sum weight_state
+}
+
+func NewAdaGrad(eta float64) *AdaGrad {
+	return &AdaGrad{Eta: eta}
+}
+
+func (s *AdaGrad) Rate(label_id int64, feature_id int64, t int64) float64 {
+	return s.Eta / math.Sqrt(1.0+s.sum.get(label_id, feature_id))
+}
+
+func (s *AdaGrad) Step(label_id int64, feature_id int64, g float64, t int64) float64 {
+	*s.sum.at(label_id, feature_id) += g * g
+	return s.Rate(label_id, feature_id, t) * g
+}
+
+func (s *AdaGrad) Clone() LearningRateSchedule {
+	c := *s
+	c.sum = copy_matrix(s.sum)
+	return &c
+}
+
+func (s *AdaGrad) merge(workers []LearningRateSchedule) {
+	sums := make([][][]float64, len(workers))
+	for i, w := range workers {
+		sums[i] = w.(*AdaGrad).sum
+	}
+	s.sum = merge_matrix(s.sum, sums)
+}
+
+// legacy_adagrad is the default schedule of NBSVM and SVM, which keeps
+// the models of earlier versions. It differs from AdaGrad in that it
+// accumulates squared steps instead of squared gradients, a step uses
+// the rate before the update, and there is no eta.
+type legacy_adagrad struct {
+	sum weight_state
+}
+
+func (s *legacy_adagrad) Rate(label_id int64, feature_id int64, t int64) float64 {
+	return 1.0 / math.Sqrt(s.sum.get(label_id, feature_id)+1.0)
+}
+
+func (s *legacy_adagrad) Step(label_id int64, feature_id int64, g float64, t int64) float64 {
+	delta := s.Rate(label_id, feature_id, t) * g
+	*s.sum.at(label_id, feature_id) += delta * delta
+	return delta
+}
+
+func (s *legacy_adagrad) Clone() LearningRateSchedule {
+	c := *s
+	c.sum = copy_matrix(s.sum)
+	return &c
+}
+
+func (s *legacy_adagrad) merge(workers []LearningRateSchedule) {
+	sums := make([][][]float64, len(workers))
+	for i, w := range workers {
+		sums[i] = w.(*legacy_adagrad).sum
+	}
+	s.sum = merge_matrix(s.sum, sums)
+}
+
+func (s *legacy_adagrad) GobEncode() ([]byte, error) {
+	return gob_encode(s.sum)
+}
+
+func (s *legacy_adagrad) GobDecode(data []byte) error {
+	return gob_decode(data, &s.sum)
+}
+
+// adagrad_state, rmsprop_state and adam_state are the states of the
+// schedules in a checkpoint.
+type adagrad_state struct {
+	Eta float64
+	Sum [][]float64
+}
+
+func (s *AdaGrad) GobEncode() ([]byte, error) {
+	return gob_encode(adagrad_state{s.Eta, s.sum})
+}
+
+func (s *AdaGrad) GobDecode(data []byte) error {
+	var x adagrad_state
+	if err := gob_decode(data, &x); err != nil {
+		return err
+	}
+	s.Eta, s.sum = x.Eta, x.Sum
+	return nil
+}
+
+// RMSProp is eta / sqrt(moving average of squared gradients) for each
+// weight. Rho is the decay of the moving average.
+type RMSProp struct {
+	Eta float64
+	Rho float64
+	avg weight_state
+}
+
+// constant to avoid division by zero
+const schedule_epsilon = 1.0e-8
+
+func NewRMSProp(eta float64, rho float64) *RMSProp {
+	return &RMSProp{Eta: eta, Rho: rho}
+}
+
+func (s *RMSProp) Rate(label_id int64, feature_id int64, t int64) float64 {
+	avg := s.avg.get(label_id, feature_id)
+	if avg == 0.0 {
+		return s.Eta
+	}
+	return s.Eta / (math.Sqrt(avg) + schedule_epsilon)
+}
+
+func (s *RMSProp) Step(label_id int64, feature_id int64, g float64, t int64) float64 {
+	avg := s.avg.at(label_id, feature_id)
+	*avg = s.Rho**avg + (1.0-s.Rho)*g*g
+	return s.Rate(label_id, feature_id, t) * g
+}
+
+func (s *RMSProp) Clone() LearningRateSchedule {
+	c := *s
+	c.avg = copy_matrix(s.avg)
+	return &c
+}
+
+func (s *RMSProp) merge(workers []LearningRateSchedule) {
+	avgs := make([][][]float64, len(workers))
+	for i, w := range workers {
+		avgs[i] = w.(*RMSProp).avg
+	}
+	s.avg = average_matrix(avgs)
+}
+
+type rmsprop_state struct {
+	Eta float64
+	Rho float64
+	Avg [][]float64
+}
+
+func (s *RMSProp) GobEncode() ([]byte, error) {
+	return gob_encode(rmsprop_state{s.Eta, s.Rho, s.avg})
+}
+
+func (s *RMSProp) GobDecode(data []byte) error {
+	var x rmsprop_state
+	if err := gob_decode(data, &x); err != nil {
+		return err
+	}
+	s.Eta, s.Rho, s.avg = x.Eta, x.Rho, x.Avg
+	return nil
+}
+
+// Adam keeps moving averages of gradients (m) and squared gradients (v)
+// for each weight. Since updates are sparse, the bias correction uses
+// the number of updates of each weight instead of t.
+// See D. P. Kingma and J. Ba, "Adam: A Method for Stochastic
+// Optimization", ICLR 2015.
+type Adam struct {
+	Eta   float64
+	Beta1 float64
+	Beta2 float64
+	m     weight_state
+	v     weight_state
+	n     weight_state // number of updates
+}
+
+func NewAdam(eta float64, beta1 float64, beta2 float64) *Adam {
+	return &Adam{Eta: eta, Beta1: beta1, Beta2: beta2}
+}
+
+func (s *Adam) Rate(label_id int64, feature_id int64, t int64) float64 {
+	n := s.n.get(label_id, feature_id)
+	if n == 0.0 {
+		return s.Eta
+	}
+	v := s.v.get(label_id, feature_id) / (1.0 - math.Pow(s.Beta2, n))
+	return s.Eta / (math.Sqrt(v) + schedule_epsilon)
+}
+
+func (s *Adam) Step(label_id int64, feature_id int64, g float64, t int64) float64 {
+	n := s.n.at(label_id, feature_id)
+	m := s.m.at(label_id, feature_id)
+	v := s.v.at(label_id, feature_id)
+	*n += 1.0
+	*m = s.Beta1**m + (1.0-s.Beta1)*g
+	*v = s.Beta2**v + (1.0-s.Beta2)*g*g
+
+	m_hat := *m / (1.0 - math.Pow(s.Beta1, *n))
+	return s.Rate(label_id, feature_id, t) * m_hat
+}
+
+func (s *Adam) Clone() LearningRateSchedule {
+	c := *s
+	c.m = copy_matrix(s.m)
+	c.v = copy_matrix(s.v)
+	c.n = copy_matrix(s.n)
+	return &c
+}
+
+func (s *Adam) merge(workers []LearningRateSchedule) {
+	ms := make([][][]float64, len(workers))
+	vs := make([][][]float64, len(workers))
+	ns := make([][][]float64, len(workers))
+	for i, w := range workers {
+		a := w.(*Adam)
+		ms[i] = a.m
+		vs[i] = a.v
+		ns[i] = a.n
+	}
+	s.m = average_matrix(ms)
+	s.v = average_matrix(vs)
+	s.n = merge_matrix(s.n, ns)
+}
+
+type adam_state struct {
+	Eta   float64
+	Beta1 float64
+	Beta2 float64
+	M     [][]float64
+	V     [][]float64
+	N     [][]float64
+}
+
+func (s *Adam) GobEncode() ([]byte, error) {
+	return gob_encode(adam_state{s.Eta, s.Beta1, s.Beta2, s.m, s.v, s.n})
+}
+
+func (s *Adam) GobDecode(data []byte) error {
+	var x adam_state
+	if err := gob_decode(data, &x); err != nil {
+		return err
+	}
+	s.Eta, s.Beta1, s.Beta2, s.m, s.v, s.n = x.Eta, x.Beta1, x.Beta2, x.M, x.V, x.N
+	return nil
+}
+
+// merge_schedules merges the states of workers into s, if s supports it.
+func merge_schedules(s LearningRateSchedule, workers []LearningRateSchedule) {
+	if m, ok := s.(schedule_merger); ok {
+		m.merge(workers)
+	}
+}
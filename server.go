@@ -0,0 +1,194 @@
+// Copyright (c) 2014 TOKUNAGA Hiroyuki
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// HTTP/JSON front end of Predictor.
+//
+//   POST /predict        {"features": {"f1": 1.0, "f2": 0.5}}
+//   POST /predict/batch  {"instances": [{"features": {...}}, ...]}
+//   GET  /healthz        200 while the process is alive
+//   GET  /readyz         200 while the server accepts requests
+
+package rakai
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+// max size of a request body, in bytes
+const max_request_size = 32 << 20
+
+type Instance struct {
+	Features map[string]float64 `json:"features"`
+	// Text is a document, which is featurized in the same way as
+	// training, if the model is trained with text input.
+	Text string `json:"text,omitempty"`
+}
+
+type BatchRequest struct {
+	Instances []Instance `json:"instances"`
+}
+
+type BatchResponse struct {
+	Predictions []Prediction `json:"predictions"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Server is an http.Handler which serves predictions of a Predictor.
+// Since it is an http.Handler, it can be tested with net/http/httptest.
+type Server struct {
+	predictor  *Predictor
+	featurizer Featurizer // nil if the model does not take text
+	mux        *http.ServeMux
+	ready      int32
+}
+
+func NewServer(p *Predictor) *Server {
+	var s Server
+	s.predictor = p
+	// an unknown featurizer is treated as none, then text is rejected
+	s.featurizer, _ = p.Featurizer()
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("/predict", s.handle_predict)
+	s.mux.HandleFunc("/predict/batch", s.handle_batch)
+	s.mux.HandleFunc("/healthz", s.handle_healthz)
+	s.mux.HandleFunc("/readyz", s.handle_readyz)
+	s.ready = 1
+	return &s
+}
+
+// SetReady changes the result of /readyz. Call SetReady(false) before
+// shutting down so that load balancers stop sending new requests.
+func (s *Server) SetReady(ready bool) {
+	if ready {
+		atomic.StoreInt32(&s.ready, 1)
+	} else {
+		atomic.StoreInt32(&s.ready, 0)
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) predict_instance(inst Instance) (Prediction, error) {
+	fvs := make([]FVS, 0, len(inst.Features))
+	if inst.Text != "" {
+		if s.featurizer == nil {
+			return Prediction{}, errors.New("model does not take text")
+		}
+		fvs = s.featurizer.Featurize(inst.Text)
+	}
+	// sorted, so that the same request always gets the same score
+	keys := make([]string, 0, len(inst.Features))
+	for k, _ := range inst.Features {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fvs = append(fvs, FVS{k, inst.Features[k]})
+	}
+	return s.predictor.Predict(fvs), nil
+}
+
+func (s *Server) handle_predict(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		write_json(w, http.StatusMethodNotAllowed, errorResponse{"method not allowed"})
+		return
+	}
+	if len(s.predictor.Labels.id2word) == 0 {
+		write_json(w, http.StatusServiceUnavailable, errorResponse{"model has no labels"})
+		return
+	}
+
+	var inst Instance
+	if err := decode_json(w, r, &inst); err != nil {
+		write_json(w, http.StatusBadRequest, errorResponse{err.Error()})
+		return
+	}
+	pr, err := s.predict_instance(inst)
+	if err != nil {
+		write_json(w, http.StatusBadRequest, errorResponse{err.Error()})
+		return
+	}
+	write_json(w, http.StatusOK, pr)
+}
+
+func (s *Server) handle_batch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		write_json(w, http.StatusMethodNotAllowed, errorResponse{"method not allowed"})
+		return
+	}
+	if len(s.predictor.Labels.id2word) == 0 {
+		write_json(w, http.StatusServiceUnavailable, errorResponse{"model has no labels"})
+		return
+	}
+
+	var req BatchRequest
+	if err := decode_json(w, r, &req); err != nil {
+		write_json(w, http.StatusBadRequest, errorResponse{err.Error()})
+		return
+	}
+
+	res := BatchResponse{make([]Prediction, len(req.Instances))}
+	for i, inst := range req.Instances {
+		pr, err := s.predict_instance(inst)
+		if err != nil {
+			write_json(w, http.StatusBadRequest, errorResponse{err.Error()})
+			return
+		}
+		res.Predictions[i] = pr
+	}
+	write_json(w, http.StatusOK, res)
+}
+
+func (s *Server) handle_healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok\n"))
+}
+
+func (s *Server) handle_readyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if atomic.LoadInt32(&s.ready) == 0 || len(s.predictor.Labels.id2word) == 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("not ready\n"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok\n"))
+}
+
+func decode_json(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, max_request_size))
+	return dec.Decode(v)
+}
+
+func write_json(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2014 TOKUNAGA Hiroyuki
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package rakai
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func new_test_server(t *testing.T) (*Server, *httptest.Server, *Predictor) {
+	cl := NewNBSVM(0.01, 0.1, 1.0e-8, true)
+	if err := TrainDataset(cl, synthetic_dataset(500, 3, 1), 1); err != nil {
+		t.Fatal(err)
+	}
+	p := cl.Freeze()
+	s := NewServer(p)
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return s, ts, p
+}
+
+func post_json(t *testing.T, url string, body string, v interface{}) int {
+	res, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if v != nil && res.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return res.StatusCode
+}
+
+func TestServerPredict(t *testing.T) {
+	_, ts, p := new_test_server(t)
+	want := p.Predict([]FVS{{"l1_f0", 1.0}, {"l1_f2", 1.0}})
+
+	var got Prediction
+	code := post_json(t, ts.URL+"/predict", `{"features": {"l1_f0": 1, "l1_f2": 1}}`, &got)
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", code)
+	}
+	if got != want || got.Label != "label1" {
+		t.Errorf("prediction = %v, want %v", got, want)
+	}
+
+	if code := post_json(t, ts.URL+"/predict", `{"features": `, nil); code != http.StatusBadRequest {
+		t.Errorf("status of broken json = %d, want 400", code)
+	}
+	if code := post_json(t, ts.URL+"/predict", `{"text": "l1_f0"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("status of text without featurizer = %d, want 400", code)
+	}
+	res, err := http.Get(ts.URL + "/predict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("status of GET = %d, want 405", res.StatusCode)
+	}
+}
+
+func TestServerPredictBatch(t *testing.T) {
+	_, ts, p := new_test_server(t)
+
+	var got BatchResponse
+	body := `{"instances": [{"features": {"l0_f1": 1}}, {"features": {"l2_f3": 1, "l2_f4": 1}}]}`
+	if code := post_json(t, ts.URL+"/predict/batch", body, &got); code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", code)
+	}
+	want := []Prediction{
+		p.Predict([]FVS{{"l0_f1", 1.0}}),
+		p.Predict([]FVS{{"l2_f3", 1.0}, {"l2_f4", 1.0}}),
+	}
+	if len(got.Predictions) != len(want) {
+		t.Fatalf("%d predictions, want %d", len(got.Predictions), len(want))
+	}
+	for i, pr := range got.Predictions {
+		if pr != want[i] {
+			t.Errorf("prediction %d = %v, want %v", i, pr, want[i])
+		}
+	}
+}
+
+func TestServerReadyz(t *testing.T) {
+	s, ts, _ := new_test_server(t)
+
+	get := func() int {
+		res, err := http.Get(ts.URL + "/readyz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	if code := get(); code != http.StatusOK {
+		t.Errorf("status = %d, want 200", code)
+	}
+	s.SetReady(false)
+	if code := get(); code != http.StatusServiceUnavailable {
+		t.Errorf("status after SetReady(false) = %d, want 503", code)
+	}
+}